@@ -0,0 +1,204 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const defaultCacheTTL = 30 * time.Second
+
+// maxCacheEntries bounds the cache, the keys hold slugs, ids and page sizes of the requests.
+const maxCacheEntries = 10000
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// catalogCache is a read-through cache for menus, category lookups and the first
+// page of the listings. Entries expire after the TTL, the least recently used are
+// evicted past maxCacheEntries and the whole cache is flushed when the products or
+// categories collections change.
+// Cached values are shared between requests and must not be modified.
+type catalogCache struct {
+	sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	// lru has the *cacheEntry, the most recently used first.
+	lru     *list.List
+	statsMu sync.Mutex
+	stats   map[string]*CacheStats
+}
+
+var cacheTTL = defaultCacheTTL
+
+func newCatalogCache(ttl time.Duration) *catalogCache {
+	return &catalogCache{
+		ttl:        ttl,
+		maxEntries: maxCacheEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		stats:      map[string]*CacheStats{},
+	}
+}
+
+// kind is the first part of the key, used to group the hit/miss metrics.
+func kind(key string) string {
+	return strings.SplitN(key, "|", 2)[0]
+}
+
+func (c *catalogCache) count(key string, hit bool) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	s, ok := c.stats[kind(key)]
+	if !ok {
+		s = &CacheStats{}
+		c.stats[kind(key)] = s
+	}
+	if hit {
+		s.Hits++
+	} else {
+		s.Misses++
+	}
+}
+
+func (c *catalogCache) get(key string) (interface{}, bool) {
+	c.Lock()
+	var v interface{}
+	el, ok := c.entries[key]
+	if ok {
+		e := el.Value.(*cacheEntry)
+		if time.Now().Before(e.expires) {
+			v = e.value
+			c.lru.MoveToFront(el)
+		} else {
+			c.remove(el)
+			ok = false
+		}
+	}
+	c.Unlock()
+	c.count(key, ok)
+	return v, ok
+}
+
+func (c *catalogCache) set(key string, v interface{}) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	e := &cacheEntry{key: key, value: v, expires: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops the entry, with the lock held.
+func (c *catalogCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// sweep drops the expired entries, the ones never read again would stay until evicted.
+func (c *catalogCache) sweep() {
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if !now.Before(el.Value.(*cacheEntry).expires) {
+			c.remove(el)
+		}
+		el = prev
+	}
+}
+
+// sweepExpired sweeps the cache every interval until the context is done.
+func (c *catalogCache) sweepExpired(interval time.Duration) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				c.sweep()
+			}
+		}
+	}
+}
+
+// remember returns the cached value for the key, calling fn to load it on a miss.
+func (c *catalogCache) remember(key string, fn func() (interface{}, error)) (interface{}, error) {
+	if v, ok := c.get(key); ok {
+		return v, nil
+	}
+	v, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, v)
+	return v, nil
+}
+
+func (c *catalogCache) flush() {
+	c.Lock()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.Unlock()
+}
+
+// Stats returns a copy of the hit/miss counters by kind of entry.
+func (c *catalogCache) Stats() map[string]CacheStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	res := map[string]CacheStats{}
+	for k, s := range c.stats {
+		res[k] = *s
+	}
+	return res
+}
+
+// watchCatalog flushes the cache on every change of the collections until the workers stop.
+// Change streams need a replica set, so on a standalone MongoDB only the TTL is used.
+func watchCatalog(w *workerGroup, c *catalogCache, colls ...*mongo.Collection) {
+	for _, coll := range colls {
+		coll := coll
+		w.Go(func(ctx context.Context) {
+			cs, err := coll.Watch(ctx, mongo.Pipeline{})
+			if err != nil {
+				logger.Warn("Change stream not available, using cache TTL", zap.String("collection", coll.Name()), zap.Error(err))
+				return
+			}
+			defer cs.Close(context.Background())
+			logger.Info("Watching for cache invalidation", zap.String("collection", coll.Name()))
+			for cs.Next(ctx) {
+				c.flush()
+			}
+			if err := cs.Err(); err != nil && ctx.Err() == nil {
+				logger.Warn("Change stream stopped, using cache TTL", zap.String("collection", coll.Name()), zap.Error(err))
+				c.flush()
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	cartTokenHeader = "x-cart-token"
+	// maxCartLines bounds the lines of a cart, like the items of CheckoutRequest.
+	maxCartLines = 100
+	// maxCartQty bounds the quantity of a line.
+	maxCartQty = 100
+	// cartSaveAttempts are the tries of a cart change when it is changed concurrently.
+	cartSaveAttempts = 3
+	// maxMergedCarts are the anonymous carts remembered as merged into a user cart.
+	maxMergedCarts = 20
+)
+
+// cartOwner is who the cart belongs to: the Keycloak sub, or the token of an anonymous cart.
+type cartOwner struct {
+	userID string
+	token  string
+}
+
+// cartOwner validates the x-user-auth-token, the x-cart-token is used only without it.
+func (srv *server) cartOwner(ctx context.Context) (cartOwner, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if t := md.Get("x-user-auth-token"); len(t) > 0 {
+		u, err := srv.identity.UserInfo(ctx, t[0])
+		if errors.Is(err, ErrInvalidToken) {
+			return cartOwner{}, status.Errorf(codes.Unauthenticated, "Invalid x-user-auth-token")
+		}
+		if err != nil {
+			return cartOwner{}, identityError(ctx, err)
+		}
+		return cartOwner{userID: u.Sub}, nil
+	}
+	if t := md.Get(cartTokenHeader); len(t) > 0 && t[0] != "" {
+		return cartOwner{token: t[0]}, nil
+	}
+	return cartOwner{}, nil
+}
+
+// owns tells if the cart belongs to the owner.
+func (o cartOwner) owns(c *MongoCart) bool {
+	if c.UserID != "" {
+		return c.UserID == o.userID
+	}
+	return o.token != "" && c.TokenHash == tokenHash(o.token)
+}
+
+// findCart returns the cart of the owner, ErrCartNotFound when there is none.
+func (srv *server) findCart(ctx context.Context, o cartOwner) (*MongoCart, error) {
+	switch {
+	case o.userID != "":
+		return srv.carts.CartByUser(ctx, o.userID)
+	case o.token != "":
+		return srv.carts.CartByToken(ctx, tokenHash(o.token))
+	}
+	return nil, ErrCartNotFound
+}
+
+func newCartToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// changeCart applies the change to the cart of the owner and saves it, reading it again
+// when another call saved it in between. The cart is created when create is true,
+// with a new token for the anonymous callers.
+func (srv *server) changeCart(ctx context.Context, create bool, change func(c *MongoCart) error) (*Cart, error) {
+	o, err := srv.cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return srv.changeCartOf(ctx, o, create, change)
+}
+
+func (srv *server) changeCartOf(ctx context.Context, o cartOwner, create bool, change func(c *MongoCart) error) (*Cart, error) {
+	token := ""
+	for attempt := 0; attempt < cartSaveAttempts; attempt++ {
+		c, err := srv.findCart(ctx, o)
+		if err == ErrCartNotFound {
+			if !create {
+				// no cart is an empty cart, for the changes that fail on it too
+				if err := change(&MongoCart{}); err != nil {
+					return nil, err
+				}
+				return &Cart{Items: []*CartItem{}}, nil
+			}
+			c = &MongoCart{UserID: o.userID, Items: []MongoCartItem{}}
+			if o.userID == "" {
+				if token, err = newCartToken(); err != nil {
+					return nil, status.Errorf(codes.Internal, "Error creating the cart token")
+				}
+				c.TokenHash = tokenHash(token)
+			}
+		} else if err != nil {
+			return nil, storeError(ctx, err)
+		}
+		if err := change(c); err != nil {
+			return nil, err
+		}
+		err = srv.carts.SaveCart(ctx, c)
+		if err == ErrCartConflict {
+			ctxLogger(ctx).Debug("Cart changed concurrently", zap.Int("attempt", attempt+1))
+			continue
+		}
+		if err != nil {
+			return nil, storeError(ctx, err)
+		}
+		res, err := srv.priceCart(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		res.Token = token
+		return res, nil
+	}
+	return nil, status.Errorf(codes.Aborted, "The cart was changed concurrently, retry")
+}
+
+// priceCart returns the cart with the current value and stock of the products, the
+// discounts of the promotions and the taxes.
+func (srv *server) priceCart(ctx context.Context, c *MongoCart) (*Cart, error) {
+	ids := make([]ObjectID, 0, len(c.Items))
+	for _, it := range c.Items {
+		ids = append(ids, it.Product)
+	}
+	ps, err := srv.products.ProductsByIDs(ctx, ids)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	byID := map[ObjectID]*MongoProductsData{}
+	for _, p := range ps {
+		byID[p.ID] = p
+	}
+	loc := requestLocale(ctx)
+	res := &Cart{Id: c.ID.Hex(), Items: []*CartItem{}, CouponCode: c.Coupon}
+	if !c.UpdatedAt.IsZero() {
+		res.UpdatedAt = timestamppb.New(c.UpdatedAt)
+	}
+	lines := make([]priceLine, 0, len(c.Items))
+	for _, it := range c.Items {
+		line := &CartItem{Product: &Product{Id: it.Product.Hex()}, Qty: it.Quantity}
+		pl := priceLine{product: it.Product, qty: it.Quantity}
+		if p, ok := byID[it.Product]; ok {
+			line.Product = dataToProd(*p, loc)
+			line.Available = p.Quantity >= it.Quantity
+			pl.category, pl.taxClass, pl.value = p.Category, p.TaxClass, p.Value
+		}
+		res.Items = append(res.Items, line)
+		res.ItemCount += it.Quantity
+		lines = append(lines, pl)
+	}
+	pr, err := srv.price(ctx, lines, c.Coupon, c.UserID, c.Destination)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range res.Items {
+		line.Total = float32(fromCents(pr.lines[i].total))
+		line.Discounts = discountsOf(pr.lines[i].discounts)
+		line.Tax = float32(fromCents(pr.tax.Lines[i]))
+	}
+	res.Subtotal = float32(fromCents(pr.subtotal))
+	res.Discount = float32(fromCents(pr.discount))
+	res.Shipping = float32(fromCents(pr.shipping))
+	res.Total = float32(fromCents(pr.total()))
+	res.Discounts = discountsOf(pr.applied)
+	res.Tax = float32(fromCents(pr.tax.Total))
+	res.Taxes = taxLinesOf(pr.tax.Taxes)
+	res.TaxIncluded = pr.tax.Included
+	res.Destination = destinationOf(c.Destination)
+	return res, nil
+}
+
+// cartProduct checks the product exists before it is added to a cart.
+func (srv *server) cartProduct(ctx context.Context, id string) (ObjectID, error) {
+	pid, err := ObjectIDFromHex(id)
+	if err != nil {
+		return NilObjectID, status.Errorf(codes.InvalidArgument, "Cannot parse ID: %v", id)
+	}
+	ps, err := srv.products.ProductsByIDs(ctx, []ObjectID{pid})
+	if err != nil {
+		return NilObjectID, storeError(ctx, err)
+	}
+	if len(ps) == 0 {
+		return NilObjectID, status.Errorf(codes.NotFound, "Product not found: %v", id)
+	}
+	return pid, nil
+}
+
+func (srv *server) GetCart(ctx context.Context, req *GetCartRequest) (*Cart, error) {
+	ctxLogger(ctx).Debug("GetCart called")
+	o, err := srv.cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := srv.findCart(ctx, o)
+	if err == ErrCartNotFound {
+		return &Cart{Items: []*CartItem{}}, nil
+	}
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	return srv.priceCart(ctx, c)
+}
+
+func (srv *server) AddCartItem(ctx context.Context, req *CartItemRequest) (*Cart, error) {
+	ctxLogger(ctx).Debug("AddCartItem called", zap.String("product_id", req.GetProductId()), zap.Int32("qty", req.GetQty()))
+	pid, err := srv.cartProduct(ctx, req.GetProductId())
+	if err != nil {
+		return nil, err
+	}
+	return srv.changeCart(ctx, true, func(c *MongoCart) error {
+		for i, it := range c.Items {
+			if it.Product == pid {
+				c.Items[i].Quantity = minInt32(it.Quantity+req.GetQty(), maxCartQty)
+				return nil
+			}
+		}
+		if len(c.Items) >= maxCartLines {
+			return status.Errorf(codes.FailedPrecondition, "The cart cannot have more than %d products", maxCartLines)
+		}
+		c.Items = append(c.Items, MongoCartItem{Product: pid, Quantity: req.GetQty(), AddedAt: time.Now()})
+		return nil
+	})
+}
+
+func (srv *server) UpdateCartItem(ctx context.Context, req *CartItemRequest) (*Cart, error) {
+	ctxLogger(ctx).Debug("UpdateCartItem called", zap.String("product_id", req.GetProductId()), zap.Int32("qty", req.GetQty()))
+	pid, _ := ObjectIDFromHex(req.GetProductId())
+	return srv.changeCart(ctx, false, func(c *MongoCart) error {
+		for i, it := range c.Items {
+			if it.Product == pid {
+				c.Items[i].Quantity = req.GetQty()
+				return nil
+			}
+		}
+		return status.Errorf(codes.NotFound, "Product not in the cart: %v", req.GetProductId())
+	})
+}
+
+func (srv *server) RemoveCartItem(ctx context.Context, req *RemoveCartItemRequest) (*Cart, error) {
+	ctxLogger(ctx).Debug("RemoveCartItem called", zap.String("product_id", req.GetProductId()))
+	pid, _ := ObjectIDFromHex(req.GetProductId())
+	return srv.changeCart(ctx, false, func(c *MongoCart) error {
+		items := c.Items[:0]
+		for _, it := range c.Items {
+			if it.Product != pid {
+				items = append(items, it)
+			}
+		}
+		c.Items = items
+		return nil
+	})
+}
+
+func (srv *server) ClearCart(ctx context.Context, req *ClearCartRequest) (*Cart, error) {
+	ctxLogger(ctx).Debug("ClearCart called")
+	return srv.changeCart(ctx, false, func(c *MongoCart) error {
+		c.Items = []MongoCartItem{}
+		return nil
+	})
+}
+
+// MergeCart adds the lines of the anonymous cart to the user cart, capping the quantities
+// at the stock, and deletes the anonymous cart.
+func (srv *server) MergeCart(ctx context.Context, req *MergeCartRequest) (*MergeCartResponse, error) {
+	ctxLogger(ctx).Debug("MergeCart called")
+	o, err := srv.cartOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if o.userID == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "Missing x-user-auth-token")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := md.Get(cartTokenHeader)
+	if len(token) == 0 || token[0] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Missing %v", cartTokenHeader)
+	}
+	anon, err := srv.carts.CartByToken(ctx, tokenHash(token[0]))
+	if err == ErrCartNotFound {
+		// already merged, or expired: the user cart as it is
+		c, err := srv.GetCart(ctx, &GetCartRequest{})
+		if err != nil {
+			return nil, err
+		}
+		return &MergeCartResponse{Cart: c, Adjustments: []*CartAdjustment{}}, nil
+	}
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	ids := []ObjectID{}
+	for _, it := range anon.Items {
+		ids = append(ids, it.Product)
+	}
+	ps, err := srv.products.ProductsByIDs(ctx, ids)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	stock := map[ObjectID]int32{}
+	for _, p := range ps {
+		stock[p.ID] = p.Quantity
+	}
+	var adjustments []*CartAdjustment
+	c, err := srv.changeCartOf(ctx, o, true, func(c *MongoCart) error {
+		adjustments = []*CartAdjustment{}
+		if containsID(c.Merged, anon.ID) {
+			return nil
+		}
+		adjustments = mergeCartItems(c, anon.Items, stock)
+		c.Merged = append(c.Merged, anon.ID)
+		if len(c.Merged) > maxMergedCarts {
+			c.Merged = c.Merged[len(c.Merged)-maxMergedCarts:]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.carts.DeleteCart(ctx, anon.ID); err != nil {
+		// it is remembered as merged, a retry only deletes it
+		ctxLogger(ctx).Error("Error deleting the merged cart", zap.Error(err), zap.String("cart_id", anon.ID.Hex()))
+	}
+	ctxLogger(ctx).Info("Cart merged", zap.String("user_id", o.userID), zap.String("cart_id", c.GetId()),
+		zap.String("anonymous_cart_id", anon.ID.Hex()), zap.Int("adjustments", len(adjustments)))
+	return &MergeCartResponse{Cart: c, Adjustments: adjustments}, nil
+}
+
+// mergeCartItems adds the items to the cart, returning the lines with less than the
+// sum of the quantities: capped at the stock or the line limit, or dropped. Only what
+// is added is adjusted, the lines the user had keep their quantities.
+func mergeCartItems(c *MongoCart, items []MongoCartItem, stock map[ObjectID]int32) []*CartAdjustment {
+	adjustments := []*CartAdjustment{}
+	for _, it := range items {
+		i := -1
+		for j, ci := range c.Items {
+			if ci.Product == it.Product {
+				i = j
+			}
+		}
+		want := it.Quantity
+		if i >= 0 {
+			want += c.Items[i].Quantity
+		}
+		qty, reason := want, ""
+		s, exists := stock[it.Product]
+		switch {
+		case !exists:
+			qty, reason = 0, "REMOVED"
+		case i < 0 && len(c.Items) >= maxCartLines:
+			qty, reason = 0, "MAX_ITEMS"
+		case s < qty && s < maxCartQty:
+			qty, reason = s, "STOCK"
+		case qty > maxCartQty:
+			qty, reason = maxCartQty, "MAX_QTY"
+		}
+		if i >= 0 && qty < c.Items[i].Quantity {
+			qty = c.Items[i].Quantity
+		}
+		if reason != "" {
+			adjustments = append(adjustments, &CartAdjustment{
+				ProductId:    it.Product.Hex(),
+				RequestedQty: want,
+				Qty:          qty,
+				Reason:       reason,
+			})
+		}
+		switch {
+		case i >= 0:
+			c.Items[i].Quantity = qty
+		case qty > 0:
+			c.Items = append(c.Items, it)
+			c.Items[len(c.Items)-1].Quantity = qty
+		}
+	}
+	return adjustments
+}
+
+// checkoutCart returns the lines of the cart of the user, or of the anonymous cart of
+// the x-cart-token, Checkout prices them like the lines sent by the client.
+func (srv *server) checkoutCart(ctx context.Context, cartID, userID string) (*MongoCart, []*CheckoutRequest_Cart, error) {
+	id, _ := ObjectIDFromHex(cartID)
+	c, err := srv.carts.CartByID(ctx, id)
+	if err == ErrCartNotFound {
+		return nil, nil, status.Errorf(codes.NotFound, "Cart not found: %v", cartID)
+	}
+	if err != nil {
+		return nil, nil, storeError(ctx, err)
+	}
+	o := cartOwner{userID: userID}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && c.UserID == "" {
+		if t := md.Get(cartTokenHeader); len(t) > 0 {
+			o.token = t[0]
+		}
+	}
+	if !o.owns(c) {
+		// the same answer as a missing cart, not to reveal the carts of the others
+		return nil, nil, status.Errorf(codes.NotFound, "Cart not found: %v", cartID)
+	}
+	if len(c.Items) == 0 {
+		return nil, nil, status.Errorf(codes.FailedPrecondition, "The cart is empty")
+	}
+	lines := []*CheckoutRequest_Cart{}
+	for _, it := range c.Items {
+		lines = append(lines, &CheckoutRequest_Cart{Product: &Product{Id: it.Product.Hex()}, Qty: it.Quantity})
+	}
+	return c, lines, nil
+}
+
+func minInt32(a, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+func cartLines(c *Cart) map[string]int32 {
+	res := map[string]int32{}
+	for _, it := range c.GetItems() {
+		res[it.GetProduct().GetName()] = it.GetQty()
+	}
+	return res
+}
+
+func TestAnonymousCart(t *testing.T) {
+	f, cl := newTestClient(t)
+	ctx := context.Background()
+
+	c, err := cl.GetCart(ctx, &GetCartRequest{})
+	if err != nil || len(c.GetItems()) != 0 || c.GetId() != "" {
+		t.Fatalf("GetCart without a cart: got %v %v", c, err)
+	}
+	c, err = cl.AddCartItem(ctx, &CartItemRequest{ProductId: f.vtm.ID.Hex(), Qty: 2})
+	if err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	if c.GetToken() == "" || c.GetId() == "" {
+		t.Fatalf("expected a new cart with a token, got %v", c)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, cartTokenHeader, c.GetToken())
+	if c, err = cl.AddCartItem(ctx, &CartItemRequest{ProductId: f.vtm.ID.Hex(), Qty: 1}); err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	if c, err = cl.AddCartItem(ctx, &CartItemRequest{ProductId: f.dice.ID.Hex(), Qty: 10}); err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	if c.GetToken() != "" {
+		t.Error("the token was sent again")
+	}
+	lines := cartLines(c)
+	if len(lines) != 2 || lines[f.vtm.Name] != 3 || lines[f.dice.Name] != 10 || c.GetItemCount() != 13 {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+	if c.GetTotal() != 179.97 || !c.GetItems()[0].GetAvailable() {
+		t.Fatalf("unexpected pricing: %v", c)
+	}
+
+	// the values and the stock are the current ones
+	f.vtm.Value = 50
+	f.vtm.Quantity = 2
+	if c, err = cl.GetCart(ctx, &GetCartRequest{}); err != nil {
+		t.Fatalf("GetCart: %v", err)
+	}
+	if c.GetItems()[0].GetTotal() != 150 || c.GetItems()[0].GetAvailable() || c.GetTotal() != 165 {
+		t.Fatalf("expected the current value and stock, got %v", c)
+	}
+
+	if c, err = cl.UpdateCartItem(ctx, &CartItemRequest{ProductId: f.vtm.ID.Hex(), Qty: 1}); err != nil {
+		t.Fatalf("UpdateCartItem: %v", err)
+	}
+	if cartLines(c)[f.vtm.Name] != 1 || !c.GetItems()[0].GetAvailable() {
+		t.Fatalf("unexpected cart: %v", c)
+	}
+	if c, err = cl.RemoveCartItem(ctx, &RemoveCartItemRequest{ProductId: f.vtm.ID.Hex()}); err != nil {
+		t.Fatalf("RemoveCartItem: %v", err)
+	}
+	if lines := cartLines(c); len(lines) != 1 || lines[f.dice.Name] != 10 {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+	if c, err = cl.ClearCart(ctx, &ClearCartRequest{}); err != nil || len(c.GetItems()) != 0 {
+		t.Fatalf("ClearCart: got %v %v", c, err)
+	}
+
+	_, err = cl.AddCartItem(ctx, &CartItemRequest{ProductId: NewObjectID().Hex(), Qty: 1})
+	assertCode(t, err, codes.NotFound)
+	_, err = cl.UpdateCartItem(ctx, &CartItemRequest{ProductId: f.vtm.ID.Hex(), Qty: 1})
+	assertCode(t, err, codes.NotFound)
+
+	other := metadata.AppendToOutgoingContext(context.Background(), cartTokenHeader, "other")
+	if c, err = cl.GetCart(other, &GetCartRequest{}); err != nil || c.GetId() != "" {
+		t.Fatalf("GetCart of an unknown token: got %v %v", c, err)
+	}
+}
+
+func TestUserCart(t *testing.T) {
+	f, cl := newTestClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "valid")
+	c, err := cl.AddCartItem(ctx, &CartItemRequest{ProductId: f.chess.ID.Hex(), Qty: 1})
+	if err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	if c.GetToken() != "" {
+		t.Fatalf("the user cart has no token, got %v", c.GetToken())
+	}
+	if carts, _ := f.store.CartByUser(ctx, "user-1"); carts == nil || carts.ID.Hex() != c.GetId() {
+		t.Fatalf("expected the cart of user-1, got %v", carts)
+	}
+	if c, err = cl.GetCart(ctx, &GetCartRequest{}); err != nil || cartLines(c)[f.chess.Name] != 1 {
+		t.Fatalf("GetCart: got %v %v", c, err)
+	}
+
+	bad := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "expired")
+	_, err = cl.GetCart(bad, &GetCartRequest{})
+	assertCode(t, err, codes.Unauthenticated)
+}
+
+func TestCheckoutCart(t *testing.T) {
+	f, cl := newTestClient(t)
+	anon := context.Background()
+	c, err := cl.AddCartItem(anon, &CartItemRequest{ProductId: f.vtm.ID.Hex(), Qty: 2})
+	if err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	anon = metadata.AppendToOutgoingContext(anon, cartTokenHeader, c.GetToken())
+
+	// the anonymous cart is checked out by the user with its token only
+	user := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "valid")
+	_, err = cl.Checkout(user, &CheckoutRequest{CartId: c.GetId()})
+	assertCode(t, err, codes.NotFound)
+	_, err = cl.Checkout(user, &CheckoutRequest{CartId: NewObjectID().Hex()})
+	assertCode(t, err, codes.NotFound)
+	_, err = cl.Checkout(user, &CheckoutRequest{CartId: c.GetId(), Cart: []*CheckoutRequest_Cart{
+		{Product: &Product{Id: f.vtm.ID.Hex()}, Qty: 1},
+	}})
+	assertCode(t, err, codes.InvalidArgument)
+
+	f.vtm.Value = 50
+	both := metadata.AppendToOutgoingContext(anon, "x-user-auth-token", "valid")
+	res, err := cl.Checkout(both, &CheckoutRequest{CartId: c.GetId()})
+	if err != nil || !res.GetValue() {
+		t.Fatalf("Checkout: got %v %v", res, err)
+	}
+	orders := f.store.Orders()
+	if len(orders) != 1 || orders[0].Total != 100 || orders[0].Items[0].Name != f.vtm.Name || orders[0].Items[0].Quantity != 2 {
+		t.Fatalf("expected the order with the current values, got %+v", orders)
+	}
+	cartID, _ := ObjectIDFromHex(c.GetId())
+	if _, err := f.store.CartByID(anon, cartID); err != ErrCartNotFound {
+		t.Fatalf("expected the cart to be deleted, got %v", err)
+	}
+	if c, err = cl.GetCart(anon, &GetCartRequest{}); err != nil || c.GetId() != "" {
+		t.Fatalf("GetCart after the checkout: got %v %v", c, err)
+	}
+
+	// the user cart, without enough stock
+	if _, err = cl.AddCartItem(user, &CartItemRequest{ProductId: f.camarilla.ID.Hex(), Qty: 1}); err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	if c, err = cl.GetCart(user, &GetCartRequest{}); err != nil {
+		t.Fatalf("GetCart: %v", err)
+	}
+	_, err = cl.Checkout(user, &CheckoutRequest{CartId: c.GetId()})
+	assertCode(t, err, codes.FailedPrecondition)
+}
+
+func TestCartPricedLikeCheckout(t *testing.T) {
+	f, cl := newTestClient(t)
+	sticker := &MongoProductsData{Name: "Sticker", Slug: "sticker", Quantity: 10, Value: 0.333, Category: f.games.ID}
+	f.store.AddProduct(sticker)
+	user := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "valid")
+	c, err := cl.AddCartItem(user, &CartItemRequest{ProductId: sticker.ID.Hex(), Qty: 3})
+	if err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	res, err := cl.Checkout(user, &CheckoutRequest{CartId: c.GetId()})
+	if err != nil || c.GetTotal() != 1 || res.GetTotal() != c.GetTotal() {
+		t.Fatalf("expected the cart total %v at the checkout, got %v %v", c.GetTotal(), res, err)
+	}
+}
+
+func TestSaveCartConflict(t *testing.T) {
+	m := NewMemoryStore()
+	ctx := context.Background()
+	c := &MongoCart{UserID: "user-1"}
+	if err := m.SaveCart(ctx, c); err != nil {
+		t.Fatalf("SaveCart: %v", err)
+	}
+	stale, _ := m.CartByID(ctx, c.ID)
+	c.Items = append(c.Items, MongoCartItem{Product: NewObjectID(), Quantity: 1})
+	if err := m.SaveCart(ctx, c); err != nil {
+		t.Fatalf("SaveCart: %v", err)
+	}
+	if err := m.SaveCart(ctx, stale); err != ErrCartConflict {
+		t.Fatalf("SaveCart of a stale cart: got %v, want a conflict", err)
+	}
+	if err := m.SaveCart(ctx, &MongoCart{UserID: "user-1"}); err != ErrCartConflict {
+		t.Fatalf("SaveCart of a second cart of the user: got %v, want a conflict", err)
+	}
+}
+
+func TestCartGateway(t *testing.T) {
+	f, hs := newTestGateway(t)
+	r, err := http.Post(hs.URL+"/v1/cart/items", "application/json", strings.NewReader(`{"productId":"`+f.dice.ID.Hex()+`","qty":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("POST /v1/cart/items: got status %v", r.StatusCode)
+	}
+}
+
+func TestMergeCart(t *testing.T) {
+	f, cl := newTestClient(t)
+	anon := context.Background()
+	c, err := cl.AddCartItem(anon, &CartItemRequest{ProductId: f.vtm.ID.Hex(), Qty: 2})
+	if err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	anon = metadata.AppendToOutgoingContext(anon, cartTokenHeader, c.GetToken())
+	for _, it := range []*CartItemRequest{
+		{ProductId: f.dice.ID.Hex(), Qty: 60},
+		{ProductId: f.camarilla.ID.Hex(), Qty: 1},
+		{ProductId: f.chess.ID.Hex(), Qty: 1},
+	} {
+		if _, err := cl.AddCartItem(anon, it); err != nil {
+			t.Fatalf("AddCartItem: %v", err)
+		}
+	}
+	user := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "valid")
+	for _, it := range []*CartItemRequest{
+		{ProductId: f.vtm.ID.Hex(), Qty: 2},
+		{ProductId: f.dice.ID.Hex(), Qty: 50},
+	} {
+		if _, err := cl.AddCartItem(user, it); err != nil {
+			t.Fatalf("AddCartItem: %v", err)
+		}
+	}
+
+	both := metadata.AppendToOutgoingContext(anon, "x-user-auth-token", "valid")
+	res, err := cl.MergeCart(both, &MergeCartRequest{})
+	if err != nil {
+		t.Fatalf("MergeCart: %v", err)
+	}
+	lines := cartLines(res.GetCart())
+	if len(lines) != 3 || lines[f.vtm.Name] != 3 || lines[f.dice.Name] != 100 || lines[f.chess.Name] != 1 {
+		t.Fatalf("unexpected lines: %v", lines)
+	}
+	got := []string{}
+	for _, a := range res.GetAdjustments() {
+		got = append(got, fmt.Sprintf("%v %v %v %v", a.GetProductId(), a.GetRequestedQty(), a.GetQty(), a.GetReason()))
+	}
+	want := []string{
+		f.vtm.ID.Hex() + " 4 3 STOCK",
+		f.dice.ID.Hex() + " 110 100 MAX_QTY",
+		f.camarilla.ID.Hex() + " 1 0 STOCK",
+	}
+	if !equal(got, want) {
+		t.Fatalf("expected adjustments %v, got %v", want, got)
+	}
+	if _, err := f.store.CartByToken(anon, tokenHash(c.GetToken())); err != ErrCartNotFound {
+		t.Fatalf("expected the anonymous cart to be deleted, got %v", err)
+	}
+
+	// a retried merge leaves the user cart as it is
+	if res, err = cl.MergeCart(both, &MergeCartRequest{}); err != nil {
+		t.Fatalf("MergeCart: %v", err)
+	}
+	if lines := cartLines(res.GetCart()); len(lines) != 3 || lines[f.dice.Name] != 100 || len(res.GetAdjustments()) != 0 {
+		t.Fatalf("unexpected merge retry: %v", res)
+	}
+
+	_, err = cl.MergeCart(anon, &MergeCartRequest{})
+	assertCode(t, err, codes.Unauthenticated)
+	_, err = cl.MergeCart(user, &MergeCartRequest{})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestMergeCartWithoutUserCart(t *testing.T) {
+	f, cl := newTestClient(t)
+	c, err := cl.AddCartItem(context.Background(), &CartItemRequest{ProductId: f.dice.ID.Hex(), Qty: 3})
+	if err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), cartTokenHeader, c.GetToken(), "x-user-auth-token", "valid")
+	res, err := cl.MergeCart(ctx, &MergeCartRequest{})
+	if err != nil {
+		t.Fatalf("MergeCart: %v", err)
+	}
+	if lines := cartLines(res.GetCart()); len(lines) != 1 || lines[f.dice.Name] != 3 || res.GetCart().GetToken() != "" {
+		t.Fatalf("unexpected cart: %v", res.GetCart())
+	}
+	if uc, err := f.store.CartByUser(ctx, "user-1"); err != nil || uc.ID.Hex() != res.GetCart().GetId() {
+		t.Fatalf("expected the cart of user-1, got %v %v", uc, err)
+	}
+}
+
+func TestMergeCartItemsFullCart(t *testing.T) {
+	c := &MongoCart{}
+	stock := map[ObjectID]int32{}
+	for i := 0; i < maxCartLines; i++ {
+		id := NewObjectID()
+		c.Items = append(c.Items, MongoCartItem{Product: id, Quantity: 1})
+		stock[id] = 10
+	}
+	low, high := NewObjectID(), NewObjectID()
+	stock[low], stock[high] = 1, 10
+	adjustments := mergeCartItems(c, []MongoCartItem{{Product: low, Quantity: 2}, {Product: high, Quantity: 1}}, stock)
+	if len(c.Items) != maxCartLines {
+		t.Fatalf("got %v lines, want %v", len(c.Items), maxCartLines)
+	}
+	if len(adjustments) != 2 || adjustments[0].GetReason() != "MAX_ITEMS" || adjustments[1].GetReason() != "MAX_ITEMS" || adjustments[0].GetQty() != 0 {
+		t.Fatalf("unexpected adjustments: %v", adjustments)
+	}
+}
+
+func TestMergeCartItemsKeepsUserLines(t *testing.T) {
+	gone, sold, low := NewObjectID(), NewObjectID(), NewObjectID()
+	c := &MongoCart{Items: []MongoCartItem{{Product: gone, Quantity: 3}, {Product: sold, Quantity: 2}, {Product: low, Quantity: 5}}}
+	stock := map[ObjectID]int32{sold: 0, low: 3}
+	adjustments := mergeCartItems(c, []MongoCartItem{{Product: gone, Quantity: 1}, {Product: sold, Quantity: 1}, {Product: low, Quantity: 1}}, stock)
+	got := []string{}
+	for _, a := range adjustments {
+		got = append(got, fmt.Sprintf("%v %v %v", a.GetRequestedQty(), a.GetQty(), a.GetReason()))
+	}
+	if want := []string{"4 3 REMOVED", "3 2 STOCK", "6 5 STOCK"}; !equal(got, want) {
+		t.Fatalf("expected adjustments %v, got %v", want, got)
+	}
+	if len(c.Items) != 3 || c.Items[0].Quantity != 3 || c.Items[1].Quantity != 2 || c.Items[2].Quantity != 5 {
+		t.Fatalf("expected the lines of the user kept, got %+v", c.Items)
+	}
+}
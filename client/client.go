@@ -2,17 +2,37 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 
 	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
 	"google.golang.org/grpc"
-	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
+	addr := flag.String("addr", "localhost:50051", "server address")
+	useTLS := flag.Bool("tls", false, "connect with TLS")
+	caFile := flag.String("ca", "", "CA of the server certificate, the system pool when empty")
+	certFile := flag.String("cert", "", "client certificate, for servers verifying the callers")
+	keyFile := flag.String("key", "", "client certificate key")
+	serverName := flag.String("server-name", "", "name expected in the server certificate, the address host when empty")
+	flag.Parse()
+
 	fmt.Println("Starting Client...")
-	cc, err := grpc.Dial("localhost:50051", grpc.WithInsecure())
+	opt := grpc.WithInsecure()
+	if *useTLS || *caFile != "" || *certFile != "" {
+		creds, err := clientTLS(*caFile, *certFile, *keyFile, *serverName)
+		if err != nil {
+			log.Fatalf("Could not load the TLS config: %v", err)
+		}
+		opt = grpc.WithTransportCredentials(creds)
+	}
+	cc, err := grpc.Dial(*addr, opt)
 	if err != nil {
 		log.Fatalf("Could not connect: %v", err)
 	}
@@ -23,9 +43,33 @@ func main() {
 	SearchProducts(cl)
 }
 
+// clientTLS returns the credentials verifying the server with the CA, presenting the
+// client certificate when set.
+func clientTLS(caFile, certFile, keyFile, serverName string) (credentials.TransportCredentials, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(cfg), nil
+}
+
 func categoriesMenu(cl EcommServiceClient) {
 	fmt.Println("Reading CategoriesMenu")
-	res, err := cl.CategoriesMenu(context.Background(), &emptypb.Empty{})
+	res, err := cl.CategoriesMenu(context.Background(), &CategoriesMenuRequest{IncludeCounts: true})
 	if err != nil {
 		fmt.Printf("Error while reading the categories menu: %v\n", err)
 	}
@@ -54,6 +98,17 @@ func CategoriesSideMenu(cl EcommServiceClient) {
 	fmt.Printf("Categories: %v\n", res)
 }
 
+func CategoryTree(cl EcommServiceClient) {
+	// Use a valid category SLUG, or empty for the whole tree
+	slug := "world-of-darkness"
+	fmt.Printf("Reading CategoryTree with slug: %v\n", slug)
+	res, err := cl.CategoryTree(context.Background(), &CategoryTreeRequest{Slug: slug, Depth: 0})
+	if err != nil {
+		fmt.Printf("Error while reading the categories tree: %v\n", err)
+	}
+	fmt.Printf("Categories: %v\n", res)
+}
+
 func Products(cl EcommServiceClient) {
 	fmt.Println("Reading Products")
 	res, err := cl.Products(context.Background(), &ProductRequest{Start: 5, Qty: 10})
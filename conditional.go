@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// conditionalInterceptor sends etag and last-modified headers for the catalog responses,
+// computed from the newest last_updated in the result, and replaces the response with
+// an empty one flagged not_modified when the client's if-none-match or if-modified-since
+// metadata shows it already has it.
+func conditionalInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	res, err := handler(ctx, req)
+	if err != nil {
+		return res, err
+	}
+	var newest time.Time
+	switch r := res.(type) {
+	case *CategoriesMenuResponse:
+		newest = newestCategories(r.Categories)
+	case *ProductsResponse:
+		newest = newestProducts(r.Data)
+	default:
+		return res, nil
+	}
+	// the newest change alone would not change when an item is removed or the locale
+	// differs, so the etag also carries a checksum of the response
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(res.(proto.Message))
+	if err != nil {
+		return res, nil
+	}
+	etag := fmt.Sprintf("W/\"%x-%08x\"", newest.UnixNano(), crc32.ChecksumIEEE(b))
+	hd := metadata.Pairs("etag", etag)
+	if !newest.IsZero() {
+		hd.Set("last-modified", newest.UTC().Format(http.TimeFormat))
+	}
+	grpc.SetHeader(ctx, hd)
+	if !notModified(ctx, etag, newest) {
+		return res, nil
+	}
+	switch res.(type) {
+	case *CategoriesMenuResponse:
+		return &CategoriesMenuResponse{NotModified: true}, nil
+	default:
+		return &ProductsResponse{NotModified: true}, nil
+	}
+}
+
+// notModified checks the request metadata, if-none-match takes precedence over if-modified-since.
+func notModified(ctx context.Context, etag string, newest time.Time) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	if inm := md.Get("if-none-match"); len(inm) > 0 {
+		for _, v := range inm {
+			for _, t := range strings.Split(v, ",") {
+				t = strings.TrimSpace(t)
+				if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if ims := md.Get("if-modified-since"); len(ims) > 0 && !newest.IsZero() {
+		t, err := http.ParseTime(ims[0])
+		if err != nil {
+			return false
+		}
+		return !newest.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+func newer(newest time.Time, ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return newest
+	}
+	if t := ts.AsTime(); t.After(newest) {
+		return t
+	}
+	return newest
+}
+
+// newestCategories returns the newest last_updated of the categories, children included.
+func newestCategories(cs []*Category) time.Time {
+	var newest time.Time
+	for _, c := range cs {
+		newest = newer(newest, c.LastUpdated)
+		for _, sub := range [][]*Category{c.Ancestors, c.Childrens} {
+			if t := newestCategories(sub); t.After(newest) {
+				newest = t
+			}
+		}
+	}
+	return newest
+}
+
+func newestProducts(ps []*Product) time.Time {
+	var newest time.Time
+	for _, p := range ps {
+		newest = newer(newest, p.LastUpdated)
+		if p.Category != nil {
+			newest = newer(newest, p.Category.LastUpdated)
+		}
+	}
+	return newest
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v2"
+)
+
+const redacted = "xxxxx"
+
+type Config struct {
+	ListenAddr string `yaml:"listen_addr"`
+	// HTTPAddr is where the REST/JSON gateway listens, empty to disable it.
+	HTTPAddr string `yaml:"http_addr"`
+	// MetricsAddr is where /metrics is served for Prometheus, empty to disable it.
+	MetricsAddr string `yaml:"metrics_addr"`
+	Store       string `yaml:"store"`
+	LogLevel    string `yaml:"log_level"`
+	// LogPII logs the emails and names of the users unredacted.
+	LogPII        bool                     `yaml:"log_pii"`
+	Mongo         MongoConfig              `yaml:"mongo"`
+	Keycloak      KeycloakConfig           `yaml:"keycloak"`
+	GRPCWeb       GRPCWebConfig            `yaml:"grpc_web"`
+	TLS           TLSConfig                `yaml:"tls"`
+	RateLimit     RateLimitConfig          `yaml:"rate_limit"`
+	Tracing       TracingConfig            `yaml:"tracing"`
+	DefaultLocale string                   `yaml:"default_locale"`
+	Locales       []string                 `yaml:"locales"`
+	CacheTTL      time.Duration            `yaml:"cache_ttl"`
+	MaxPageSize   int32                    `yaml:"max_page_size"`
+	RPCTimeout    time.Duration            `yaml:"rpc_timeout"`
+	RPCTimeouts   map[string]time.Duration `yaml:"rpc_timeouts"`
+	// ShutdownTimeout is how long the in-flight calls can take to finish on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// HealthInterval is how often the dependencies reported by grpc.health.v1 are checked.
+	HealthInterval time.Duration `yaml:"health_interval"`
+	// ShippingFee is the flat shipping of every order, waived by the free shipping promotions.
+	ShippingFee float64   `yaml:"shipping_fee"`
+	Tax         TaxConfig `yaml:"tax"`
+}
+
+type TaxConfig struct {
+	// RulesFile has the tax rules, no tax is charged without it.
+	RulesFile string `yaml:"rules_file"`
+	// DefaultDestination taxes the carts and the orders without a destination.
+	DefaultDestination TaxDestination `yaml:"default_destination"`
+}
+
+type MongoConfig struct {
+	// URI is used as is when set, otherwise it is built from the host and the credentials.
+	URI            string        `yaml:"uri"`
+	Host           string        `yaml:"host"`
+	Username       string        `yaml:"username"`
+	Password       string        `yaml:"password"`
+	Database       string        `yaml:"database"`
+	ReplicaSet     string        `yaml:"replica_set"`
+	TLS            bool          `yaml:"tls"`
+	TLSCAFile      string        `yaml:"tls_ca_file"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+}
+
+type KeycloakConfig struct {
+	URL string `yaml:"url"`
+	// Timeout is the timeout of each call to the userinfo endpoint.
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries are the extra calls after a failure, waiting a jittered RetryBackoff doubled each time.
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// BreakerFailures calls failed in a row make the next calls fail fast for BreakerCooldown, 0 disables the breaker.
+	BreakerFailures int           `yaml:"breaker_failures"`
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
+	// CacheTTL is how long a validated token is trusted without asking Keycloak again, 0 to always ask.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// TLSConfig is the TLS of the gRPC and HTTP listeners, enabled when CertFile is set.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile are the CAs of the client certificates of the internal callers.
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAuth is none, optional (verified when sent) or require, on the gRPC and the HTTP
+	// listeners: with require the browsers need a client certificate for gRPC-Web too.
+	ClientAuth string `yaml:"client_auth"`
+	// ReloadInterval is how often the files are checked for a rotation.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// RateLimitConfig are the token buckets of the calls, by user or by IP for the anonymous calls.
+type RateLimitConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Store is memory, for a single instance, or redis to share the limits between the instances.
+	Store     string `yaml:"store"`
+	RedisAddr string `yaml:"redis_addr"`
+	// Default is the limit of the methods not in Methods, unlimited when its rate is 0.
+	Default RateLimit            `yaml:"default"`
+	Methods map[string]RateLimit `yaml:"methods"`
+}
+
+type TracingConfig struct {
+	// Exporter is none, stdout or otlp.
+	Exporter     string  `yaml:"exporter"`
+	OTLPEndpoint string  `yaml:"otlp_endpoint"`
+	SampleRatio  float64 `yaml:"sample_ratio"`
+}
+
+// GRPCWebConfig is the gRPC-Web of the browsers, served on the HTTP address.
+type GRPCWebConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// AllowedOrigins are the CORS origins of the frontend, "*" allows any.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// Websockets is only needed for the client streaming of the gRPC-Web clients.
+	Websockets bool `yaml:"websockets"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:      "0.0.0.0:50051",
+		HTTPAddr:        "0.0.0.0:8080",
+		MetricsAddr:     "0.0.0.0:9102",
+		Store:           "mongo",
+		LogLevel:        "info",
+		DefaultLocale:   "en",
+		CacheTTL:        defaultCacheTTL,
+		MaxPageSize:     defaultMaxPageSize,
+		RPCTimeout:      defaultRPCTimeout,
+		RPCTimeouts:     map[string]time.Duration{},
+		ShutdownTimeout: defaultShutdownTimeout,
+		HealthInterval:  defaultHealthInterval,
+		GRPCWeb: GRPCWebConfig{
+			Enabled:        true,
+			AllowedOrigins: []string{"http://localhost:3000"},
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:   true,
+			Store:     "memory",
+			RedisAddr: "localhost:6379",
+		},
+		TLS: TLSConfig{
+			ClientAuth:     "none",
+			ReloadInterval: defaultTLSReloadInterval,
+		},
+		Tracing: TracingConfig{
+			Exporter:     "none",
+			OTLPEndpoint: "localhost:4317",
+			SampleRatio:  1,
+		},
+		Mongo: MongoConfig{
+			Host:           "localhost:27017",
+			ConnectTimeout: 10 * time.Second,
+		},
+		Keycloak: KeycloakConfig{
+			Timeout:         defaultKeycloakTimeout,
+			Retries:         defaultKeycloakRetries,
+			RetryBackoff:    defaultKeycloakRetryBackoff,
+			BreakerFailures: defaultKeycloakBreakerFailures,
+			BreakerCooldown: defaultKeycloakBreakerCooldown,
+			CacheTTL:        defaultKeycloakCacheTTL,
+		},
+	}
+}
+
+// loadConfig builds the configuration from the defaults, the optional YAML file
+// (-config or CONFIG_FILE), the environment and the flags, in this order.
+func loadConfig(args []string) (*Config, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("ecomm", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	listen := fs.String("listen", "", "gRPC listen address")
+	httpAddr := fs.String("http", "", "REST/JSON gateway listen address, empty to disable")
+	store := fs.String("store", "", "catalog store: mongo or memory")
+	logLevel := fs.String("log-level", "", "log level: debug, info, warn or error")
+	mongoURI := fs.String("mongo-uri", "", "MongoDB connection URI")
+	mongoDb := fs.String("mongo-db", "", "MongoDB database")
+	keycloakURL := fs.String("keycloak-url", "", "Keycloak userinfo endpoint")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *file != "" {
+		b, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+			return nil, fmt.Errorf("parsing config file %v: %v", *file, err)
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+	// the defaults are replaced, not merged, by the limits of the file or the environment
+	if cfg.RateLimit.Methods == nil {
+		cfg.RateLimit.Methods = map[string]RateLimit{
+			"SearchProducts": {Rate: 5, Burst: 20},
+			"Checkout":       {Rate: 0.2, Burst: 5},
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddr = *listen
+		case "http":
+			cfg.HTTPAddr = *httpAddr
+		case "store":
+			cfg.Store = *store
+		case "log-level":
+			cfg.LogLevel = *logLevel
+		case "mongo-uri":
+			cfg.Mongo.URI = *mongoURI
+		case "mongo-db":
+			cfg.Mongo.Database = *mongoDb
+		case "keycloak-url":
+			cfg.Keycloak.URL = *keycloakURL
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadEnv() error {
+	errs := []string{}
+	str := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	dur := func(name string, dst *time.Duration) {
+		if v, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+			}
+			*dst = d
+		}
+	}
+	str("LISTEN_ADDR", &c.ListenAddr)
+	str("HTTP_ADDR", &c.HTTPAddr)
+	str("METRICS_ADDR", &c.MetricsAddr)
+	str("STORE", &c.Store)
+	str("LOG_LEVEL", &c.LogLevel)
+	str("MONGO_URI", &c.Mongo.URI)
+	str("MONGO_HOST", &c.Mongo.Host)
+	str("MONGO_USERNAME", &c.Mongo.Username)
+	str("MONGO_PASSWORD", &c.Mongo.Password)
+	str("MONGO_DB", &c.Mongo.Database)
+	str("MONGO_REPLICA_SET", &c.Mongo.ReplicaSet)
+	str("MONGO_TLS_CA_FILE", &c.Mongo.TLSCAFile)
+	dur("MONGO_CONNECT_TIMEOUT", &c.Mongo.ConnectTimeout)
+	str("KEYCLOAK_URL", &c.Keycloak.URL)
+	dur("KEYCLOAK_TIMEOUT", &c.Keycloak.Timeout)
+	dur("KEYCLOAK_RETRY_BACKOFF", &c.Keycloak.RetryBackoff)
+	dur("KEYCLOAK_BREAKER_COOLDOWN", &c.Keycloak.BreakerCooldown)
+	dur("KEYCLOAK_CACHE_TTL", &c.Keycloak.CacheTTL)
+	str("TLS_CERT_FILE", &c.TLS.CertFile)
+	str("TLS_KEY_FILE", &c.TLS.KeyFile)
+	str("TLS_CLIENT_CA_FILE", &c.TLS.ClientCAFile)
+	str("TLS_CLIENT_AUTH", &c.TLS.ClientAuth)
+	dur("TLS_RELOAD_INTERVAL", &c.TLS.ReloadInterval)
+	str("RATE_LIMIT_STORE", &c.RateLimit.Store)
+	str("RATE_LIMIT_REDIS_ADDR", &c.RateLimit.RedisAddr)
+	str("TRACING_EXPORTER", &c.Tracing.Exporter)
+	str("OTLP_ENDPOINT", &c.Tracing.OTLPEndpoint)
+	str("DEFAULT_LOCALE", &c.DefaultLocale)
+	dur("CACHE_TTL", &c.CacheTTL)
+	dur("RPC_TIMEOUT", &c.RPCTimeout)
+	dur("SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	dur("HEALTH_INTERVAL", &c.HealthInterval)
+	str("TAX_RULES_FILE", &c.Tax.RulesFile)
+	str("TAX_DEFAULT_COUNTRY", &c.Tax.DefaultDestination.Country)
+	str("TAX_DEFAULT_REGION", &c.Tax.DefaultDestination.Region)
+	boolean := func(name string, dst *bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+			}
+			*dst = b
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = []string{}
+			for _, l := range strings.Split(v, ",") {
+				if l = strings.TrimSpace(l); l != "" {
+					*dst = append(*dst, l)
+				}
+			}
+		}
+	}
+	boolean("LOG_PII", &c.LogPII)
+	boolean("MONGO_TLS", &c.Mongo.TLS)
+	list("LOCALES", &c.Locales)
+	boolean("GRPC_WEB", &c.GRPCWeb.Enabled)
+	boolean("GRPC_WEB_WEBSOCKETS", &c.GRPCWeb.Websockets)
+	list("CORS_ALLOWED_ORIGINS", &c.GRPCWeb.AllowedOrigins)
+	boolean("RATE_LIMIT", &c.RateLimit.Enabled)
+	for name, dst := range map[string]*float64{
+		"TRACING_SAMPLE_RATIO": &c.Tracing.SampleRatio,
+		"SHIPPING_FEE":         &c.ShippingFee,
+	} {
+		if v, ok := os.LookupEnv(name); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+			}
+			*dst = f
+		}
+	}
+	for name, dst := range map[string]*int{
+		"KEYCLOAK_RETRIES":          &c.Keycloak.Retries,
+		"KEYCLOAK_BREAKER_FAILURES": &c.Keycloak.BreakerFailures,
+	} {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+			}
+			*dst = n
+		}
+	}
+	if v, ok := os.LookupEnv("MAX_PAGE_SIZE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("MAX_PAGE_SIZE: %v", err))
+		}
+		c.MaxPageSize = int32(n)
+	}
+	// e.g. RPC_TIMEOUTS=Checkout=10s,SearchProducts=2s
+	for _, p := range strings.Split(os.Getenv("RPC_TIMEOUTS"), ",") {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			errs = append(errs, fmt.Sprintf("RPC_TIMEOUTS: expected Method=duration, got %v", p))
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("RPC_TIMEOUTS: %v", err))
+		}
+		c.RPCTimeouts[strings.TrimSpace(kv[0])] = d
+	}
+	// e.g. RATE_LIMITS=SearchProducts=5:20,Checkout=0.2:5, rate per second and burst
+	for _, p := range strings.Split(os.Getenv("RATE_LIMITS"), ",") {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		var rb []string
+		if len(kv) == 2 {
+			rb = strings.SplitN(kv[1], ":", 2)
+		}
+		if len(rb) != 2 {
+			errs = append(errs, fmt.Sprintf("RATE_LIMITS: expected Method=rate:burst, got %v", p))
+			continue
+		}
+		r, err := strconv.ParseFloat(strings.TrimSpace(rb[0]), 64)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("RATE_LIMITS: %v", err))
+		}
+		b, err := strconv.Atoi(strings.TrimSpace(rb[1]))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("RATE_LIMITS: %v", err))
+		}
+		if c.RateLimit.Methods == nil {
+			c.RateLimit.Methods = map[string]RateLimit{}
+		}
+		c.RateLimit.Methods[strings.TrimSpace(kv[0])] = RateLimit{Rate: r, Burst: b}
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid environment: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Validate returns every problem of the configuration in one error.
+func (c *Config) Validate() error {
+	errs := []string{}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Sprintf("listen_addr %q: %v", c.ListenAddr, err))
+	}
+	if c.HTTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPAddr); err != nil {
+			errs = append(errs, fmt.Sprintf("http_addr %q: %v", c.HTTPAddr, err))
+		}
+	} else if c.GRPCWeb.Enabled {
+		errs = append(errs, "grpc_web needs http_addr")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, "tls.cert_file and tls.key_file must be set together")
+	}
+	for _, f := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ClientCAFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			errs = append(errs, fmt.Sprintf("tls: %v", err))
+		}
+	}
+	switch c.TLS.ClientAuth {
+	case "none":
+	case "optional", "require":
+		if c.TLS.CertFile == "" || c.TLS.ClientCAFile == "" {
+			errs = append(errs, "tls.client_auth needs tls.cert_file and tls.client_ca_file")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("tls.client_auth must be none, optional or require, got %q", c.TLS.ClientAuth))
+	}
+	if c.TLS.ReloadInterval <= 0 {
+		errs = append(errs, "tls.reload_interval must be positive")
+	}
+	switch c.RateLimit.Store {
+	case "memory":
+	case "redis":
+		if c.RateLimit.RedisAddr == "" {
+			errs = append(errs, "rate_limit.redis_addr is required")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("rate_limit.store must be memory or redis, got %q", c.RateLimit.Store))
+	}
+	limits := map[string]RateLimit{"default": c.RateLimit.Default}
+	for m, l := range c.RateLimit.Methods {
+		limits["methods."+m] = l
+	}
+	for n, l := range limits {
+		if l.Rate < 0 {
+			errs = append(errs, fmt.Sprintf("rate_limit.%v.rate cannot be negative", n))
+		} else if l.Rate > 0 && l.Burst < 1 {
+			errs = append(errs, fmt.Sprintf("rate_limit.%v.burst must be at least 1", n))
+		}
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Tracing.OTLPEndpoint == "" {
+			errs = append(errs, "tracing.otlp_endpoint is required")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("tracing.exporter must be none, stdout or otlp, got %q", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, "tracing.sample_ratio must be between 0 and 1")
+	}
+	if c.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			errs = append(errs, fmt.Sprintf("metrics_addr %q: %v", c.MetricsAddr, err))
+		}
+	}
+	switch c.Store {
+	case "memory":
+	case "mongo":
+		if c.Mongo.URI == "" && c.Mongo.Host == "" {
+			errs = append(errs, "mongo.uri or mongo.host is required")
+		}
+		if c.Mongo.URI != "" {
+			if u, err := url.Parse(c.Mongo.URI); err != nil || (u.Scheme != "mongodb" && u.Scheme != "mongodb+srv") {
+				errs = append(errs, "mongo.uri must be a mongodb:// or mongodb+srv:// URI")
+			}
+		}
+		if c.Mongo.Database == "" {
+			errs = append(errs, "mongo.database is required")
+		}
+		if c.Mongo.ConnectTimeout <= 0 {
+			errs = append(errs, "mongo.connect_timeout must be positive")
+		}
+		if c.Mongo.TLSCAFile != "" {
+			if _, err := os.Stat(c.Mongo.TLSCAFile); err != nil {
+				errs = append(errs, fmt.Sprintf("mongo.tls_ca_file: %v", err))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("store must be mongo or memory, got %q", c.Store))
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Sprintf("log_level must be debug, info, warn or error, got %q", c.LogLevel))
+	}
+	if c.Keycloak.URL == "" {
+		if c.Store != "memory" {
+			errs = append(errs, "keycloak.url is required")
+		}
+	} else if u, err := url.Parse(c.Keycloak.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Sprintf("keycloak.url %q must be an absolute URL", c.Keycloak.URL))
+	}
+	if c.Keycloak.Timeout <= 0 {
+		errs = append(errs, "keycloak.timeout must be positive")
+	}
+	if c.Keycloak.Retries < 0 || c.Keycloak.RetryBackoff < 0 || c.Keycloak.BreakerFailures < 0 || c.Keycloak.CacheTTL < 0 {
+		errs = append(errs, "keycloak.retries, retry_backoff, breaker_failures and cache_ttl cannot be negative")
+	}
+	if c.Keycloak.BreakerFailures > 0 && c.Keycloak.BreakerCooldown <= 0 {
+		errs = append(errs, "keycloak.breaker_cooldown must be positive")
+	}
+	if c.DefaultLocale == "" {
+		errs = append(errs, "default_locale is required")
+	}
+	if c.CacheTTL < 0 {
+		errs = append(errs, "cache_ttl cannot be negative")
+	}
+	if c.MaxPageSize < 1 {
+		errs = append(errs, "max_page_size must be at least 1")
+	}
+	if c.RPCTimeout <= 0 {
+		errs = append(errs, "rpc_timeout must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, "shutdown_timeout must be positive")
+	}
+	if c.HealthInterval <= 0 {
+		errs = append(errs, "health_interval must be positive")
+	}
+	if c.ShippingFee < 0 {
+		errs = append(errs, "shipping_fee cannot be negative")
+	}
+	if c.Tax.RulesFile != "" {
+		if _, err := os.Stat(c.Tax.RulesFile); err != nil {
+			errs = append(errs, fmt.Sprintf("tax.rules_file: %v", err))
+		}
+	}
+	if d := c.Tax.DefaultDestination; d.Country == "" && d.Region != "" {
+		errs = append(errs, "tax.default_destination.region needs a country")
+	}
+	for m, d := range c.RPCTimeouts {
+		if d <= 0 {
+			errs = append(errs, fmt.Sprintf("rpc_timeouts.%v must be positive", m))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// MongoURI returns the connection URI, built from the host and the credentials when no URI is set.
+func (c *MongoConfig) MongoURI() string {
+	if c.URI != "" {
+		return c.URI
+	}
+	if c.Username == "" {
+		return fmt.Sprintf("mongodb://%s", c.Host)
+	}
+	u := url.URL{Scheme: "mongodb", User: url.UserPassword(c.Username, c.Password), Host: c.Host}
+	return u.String()
+}
+
+func (c *MongoConfig) ClientOptions() (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(c.MongoURI())
+	if c.ReplicaSet != "" {
+		opts.SetReplicaSet(c.ReplicaSet)
+	}
+	if c.TLS || c.TLSCAFile != "" {
+		tc := &tls.Config{}
+		if c.TLSCAFile != "" {
+			pem, err := ioutil.ReadFile(c.TLSCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tc.RootCAs = x509.NewCertPool()
+			if !tc.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %v", c.TLSCAFile)
+			}
+		}
+		opts.SetTLSConfig(tc)
+	}
+	return opts, opts.Validate()
+}
+
+// String returns the configuration as YAML, with the passwords redacted.
+func (c Config) String() string {
+	if c.Mongo.Password != "" {
+		c.Mongo.Password = redacted
+	}
+	if u, err := url.Parse(c.Mongo.URI); err != nil {
+		// the uri may still hold the credentials
+		c.Mongo.URI = "<invalid uri>"
+	} else if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			c.Mongo.URI = u.String()
+		}
+	}
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+// apply sets the package settings used by the handlers and the interceptors.
+func (c *Config) apply() {
+	setLocales(c.DefaultLocale, c.Locales)
+	cacheTTL = c.CacheTTL
+	maxPageSize = c.MaxPageSize
+	rpcTimeout = c.RPCTimeout
+	rpcTimeouts = c.RPCTimeouts
+	logPII = c.LogPII
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type CategoryCount struct {
+	Total   int32
+	InStock int32
+}
+
+type MongoProductCount struct {
+	ID      ObjectID `bson:"_id,omitempty"`
+	Total   int32    `bson:"total,omitempty"`
+	InStock int32    `bson:"in_stock,omitempty"`
+}
+
+// loadCounts returns the cached product counts, so the menus don't need to run
+// a count for each category on every render.
+func (srv *server) loadCounts(ctx context.Context) (map[ObjectID]CategoryCount, error) {
+	v, err := srv.cache.remember("counts", func() (interface{}, error) {
+		return srv.countProducts(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[ObjectID]CategoryCount), nil
+}
+
+// countProducts returns, for each category, the number of products (and in stock
+// products) in the category itself and in all of its descendants.
+func (srv *server) countProducts(ctx context.Context) (map[ObjectID]CategoryCount, error) {
+	own, err := srv.products.CountProducts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("counting products: %w", err)
+	}
+	ds, err := srv.categories.CategoriesWithDescendants(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading categories: %w", err)
+	}
+	counts := map[ObjectID]CategoryCount{}
+	for _, d := range ds {
+		c := own[d.ID]
+		for _, sc := range d.Subcategories {
+			c.Total += own[sc.ID].Total
+			c.InStock += own[sc.ID].InStock
+		}
+		counts[d.ID] = c
+	}
+	return counts, nil
+}
+
+// withCounts sets the product counts on the category and its children.
+func withCounts(c *Category, counts map[ObjectID]CategoryCount) {
+	if oid, err := ObjectIDFromHex(c.Id); err == nil {
+		c.ProductCount = counts[oid].Total
+		c.InStockCount = counts[oid].InStock
+	}
+	for _, cc := range c.Childrens {
+		withCounts(cc, counts)
+	}
+}
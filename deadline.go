@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultRPCTimeout = 5 * time.Second
+
+var rpcTimeout = defaultRPCTimeout
+var rpcTimeouts = map[string]time.Duration{}
+
+func timeoutFor(fullMethod string) time.Duration {
+	if d, ok := rpcTimeouts[path.Base(fullMethod)]; ok {
+		return d
+	}
+	return rpcTimeout
+}
+
+// deadlineInterceptor applies the method default timeout when the client did not send a deadline.
+func deadlineInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeoutFor(info.FullMethod))
+		defer cancel()
+	}
+	return handler(ctx, req)
+}
+
+// storeError converts an error from the repositories to a gRPC status, keeping
+// the deadline and the cancellation of the call.
+func storeError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err):
+		return status.Errorf(codes.DeadlineExceeded, "Deadline exceeded")
+	case errors.Is(ctx.Err(), context.Canceled) || errors.Is(err, context.Canceled):
+		return status.Errorf(codes.Canceled, "Request canceled")
+	}
+	return status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
+}
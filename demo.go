@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// seedDemo fills the store with a small catalog, used when running with STORE=memory.
+func seedDemo(m *MemoryStore) {
+	now := timestamppb.New(time.Now())
+	rpg := &MongoCategories{ID: NewObjectID(), Name: "RPG", Slug: "rpg", LastUpdated: now}
+	m.AddCategory(rpg)
+	wod := &MongoCategories{
+		ID:        NewObjectID(),
+		Name:      "World of Darkness",
+		Slug:      "world-of-darkness",
+		Ancestors: []ObjectID{rpg.ID},
+		Translations: []MongoTranslation{
+			{Locale: "pt-BR", Name: "Mundo das Trevas", Slug: "mundo-das-trevas"},
+		},
+		LastUpdated: now,
+	}
+	m.AddCategory(wod)
+	vampire := &MongoCategories{ID: NewObjectID(), Name: "Vampire", Slug: "vampire", Ancestors: []ObjectID{rpg.ID, wod.ID}, LastUpdated: now}
+	m.AddCategory(vampire)
+	dnd := &MongoCategories{ID: NewObjectID(), Name: "Dungeons & Dragons", Slug: "dungeons-dragons", Ancestors: []ObjectID{rpg.ID}, LastUpdated: now}
+	m.AddCategory(dnd)
+	board := &MongoCategories{ID: NewObjectID(), Name: "Board Games", Slug: "board-games", LastUpdated: now}
+	m.AddCategory(board)
+
+	for _, p := range []*MongoProductsData{
+		{Name: "Vampire: The Masquerade 5th Edition", Slug: "vampire-the-masquerade-5th-edition", Image: "vtm5.jpg", Quantity: 10, Value: 54.99, Category: vampire.ID},
+		{Name: "Camarilla", Slug: "camarilla", Image: "camarilla.jpg", Quantity: 0, Value: 44.99, Category: vampire.ID},
+		{Name: "Dungeon Master's Guide", Slug: "dungeon-masters-guide", Image: "dmg.jpg", Quantity: 5, Value: 49.95, Category: dnd.ID},
+		{Name: "Player's Handbook", Slug: "players-handbook", Image: "phb.jpg", Quantity: 8, Value: 49.95, Category: dnd.ID},
+		{
+			Name: "Dragon Heist", Slug: "dragon-heist", Image: "dragon-heist.jpg", Quantity: 3, Value: 39.99, Category: dnd.ID,
+			Translations: []MongoTranslation{{Locale: "pt-BR", Name: "Roubo do Dragão", Slug: "roubo-do-dragao"}},
+		},
+		{Name: "Catan", Slug: "catan", Image: "catan.jpg", Quantity: 12, Value: 44.0, Category: board.ID},
+	} {
+		p.LastUpdated = now
+		m.AddProduct(p)
+	}
+
+	m.AddPromotion(&MongoPromotion{Name: "Free shipping over 100", Type: PromotionFreeShipping, MinCartValue: 100})
+	m.AddPromotion(&MongoPromotion{Name: "10% off RPG", Code: "RPG10", Type: PromotionPercentage, Value: 10, Categories: []ObjectID{rpg.ID}, MaxUsesPerCustomer: 1})
+	m.AddPromotion(&MongoPromotion{Name: "Board games: buy 2, get 1 free", Type: PromotionBuyXGetY, BuyQty: 2, GetQty: 1, Categories: []ObjectID{board.ID}})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"google.golang.org/grpc"
+)
+
+// gatewayHeaders are the HTTP headers passed as is to the gRPC metadata and back,
+// so the REST routes have the same locale, conditional read and checkout auth.
+var gatewayHeaders = map[string]bool{
+	"accept-language":   true,
+	"if-none-match":     true,
+	"if-modified-since": true,
+	"x-user-auth-token": true,
+	"x-cart-token":      true,
+	"x-request-id":      true,
+	"content-language":  true,
+	"etag":              true,
+	"last-modified":     true,
+	"retry-after":       true,
+}
+
+func gatewayHeader(key string) (string, bool) {
+	if k := strings.ToLower(key); gatewayHeaders[k] {
+		return k, true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+func gatewayOutgoingHeader(key string) (string, bool) {
+	if gatewayHeaders[key] {
+		return key, true
+	}
+	return runtime.MetadataHeaderPrefix + key, true
+}
+
+// newGateway returns the HTTP/JSON handler with the routes of the google.api.http
+// options of ecomm.proto, calling the gRPC server at endpoint so every interceptor applies.
+func newGateway(ctx context.Context, endpoint string, opts ...grpc.DialOption) (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(gatewayHeader),
+		runtime.WithOutgoingHeaderMatcher(gatewayOutgoingHeader),
+	)
+	opts = append(opts, grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()))
+	if err := RegisterEcommServiceHandlerFromEndpoint(ctx, mux, endpoint, opts); err != nil {
+		return nil, err
+	}
+	return otelhttp.NewHandler(mux, "gateway"), nil
+}
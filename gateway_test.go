@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestGateway serves the gateway of the fixture over HTTP, opts set up the server.
+func newTestGateway(t *testing.T, opts ...func(*server)) (*fixture, *httptest.Server) {
+	setLocales("en", []string{"pt-BR"})
+	f := newFixture()
+	l := bufconn.Listen(1024 * 1024)
+	srv := newServer(f.store)
+	srv.identity = fakeKeycloak(t)
+	for _, o := range opts {
+		o(srv)
+	}
+	s := newGRPCServer(srv)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	h, err := newGateway(ctx, "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatalf("newGateway: %v", err)
+	}
+	hs := httptest.NewServer(h)
+	t.Cleanup(hs.Close)
+	return f, hs
+}
+
+func TestGateway(t *testing.T) {
+	f, hs := newTestGateway(t)
+
+	type category struct {
+		Name      string
+		Ancestors []struct{ Name string }
+	}
+	var res struct {
+		Total      int32
+		Data       []struct{ Name string }
+		Categories []category
+	}
+	get := func(path string, hd http.Header, want int) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, hs.URL+path, nil)
+		for k, v := range hd {
+			req.Header[k] = v
+		}
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %v: %v", path, err)
+		}
+		defer r.Body.Close()
+		if r.StatusCode != want {
+			t.Fatalf("GET %v: got status %v, want %v", path, r.StatusCode, want)
+		}
+		res.Total, res.Data, res.Categories = 0, nil, nil
+		json.NewDecoder(r.Body).Decode(&res)
+		return r
+	}
+
+	r := get("/v1/products?start=0&qty=2", nil, http.StatusOK)
+	if res.Total != 4 || len(res.Data) != 2 || res.Data[0].Name != "Camarilla" {
+		t.Errorf("products: got %+v", res)
+	}
+	if r.Header.Get("Etag") == "" {
+		t.Error("products: missing ETag header")
+	}
+
+	get("/v1/categories/vampire/breadcrumb", nil, http.StatusOK)
+	if len(res.Categories) != 1 || len(res.Categories[0].Ancestors) != 2 || res.Categories[0].Ancestors[1].Name != "RPG" {
+		t.Errorf("breadcrumb: got %+v", res.Categories)
+	}
+
+	r = get("/v1/categories/jogos-de-interpretacao/breadcrumb", http.Header{"Accept-Language": {"pt-BR"}}, http.StatusOK)
+	if got := r.Header.Get("Content-Language"); got != "pt-BR" {
+		t.Errorf("Content-Language: got %q", got)
+	}
+
+	get("/v1/categories/"+f.vampire.ID.Hex()+"/products?qty=10", nil, http.StatusOK)
+	if res.Total != 2 {
+		t.Errorf("category products: got %+v", res)
+	}
+	get("/v1/products/search?name=dice&qty=10", nil, http.StatusOK)
+	if len(res.Data) != 1 {
+		t.Errorf("search: got %+v", res)
+	}
+	get("/v1/categories/"+NewObjectID().Hex()+"/products?qty=10", nil, http.StatusNotFound)
+	get("/v1/products?qty=0", nil, http.StatusBadRequest)
+
+	body := `{"cart":[{"product":{"id":"` + NewObjectID().Hex() + `"},"qty":1}]}`
+	r, err := http.Post(hs.URL+"/v1/checkout", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusUnauthorized {
+		t.Errorf("checkout without token: got status %v", r.StatusCode)
+	}
+}
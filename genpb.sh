@@ -1,3 +1,4 @@
 #!/bin/bash
 
-protoc ecommpb/ecomm.proto --go_out=plugins=grpc:.
+protoc -I . -I third_party/googleapis ecommpb/*.proto --go_out=plugins=grpc:.
+protoc -I . -I third_party/googleapis ecommpb/ecomm.proto --grpc-gateway_out=. --openapiv2_out=.
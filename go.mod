@@ -3,8 +3,23 @@ module github.com/gugazimmermann/go-grpc-ecomm-go
 go 1.15
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.3
+	github.com/go-redis/redis/v8 v8.11.4
+	github.com/grpc-ecosystem/grpc-gateway/v2 v2.4.0
+	github.com/improbable-eng/grpc-web v0.14.1
 	github.com/joho/godotenv v1.3.0
+	github.com/prometheus/client_golang v1.10.0
 	go.mongodb.org/mongo-driver v1.5.1
+	go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.20.0
+	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.20.0
+	go.opentelemetry.io/otel v0.20.0
+	go.opentelemetry.io/otel/exporters/otlp v0.20.0
+	go.opentelemetry.io/otel/exporters/stdout v0.20.0
+	go.opentelemetry.io/otel/sdk v0.20.0
+	go.opentelemetry.io/otel/trace v0.20.0
+	go.uber.org/zap v1.16.0
+	google.golang.org/genproto v0.0.0-20210426193834-eac7f76ac494
 	google.golang.org/grpc v1.37.0
 	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v2 v2.4.0
 )
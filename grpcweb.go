@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/improbable-eng/grpc-web/go/grpcweb"
+	"google.golang.org/grpc"
+)
+
+// newGRPCWeb serves the gRPC-Web calls (and their CORS pre-flights) of the browsers with
+// the gRPC server, so they go through the same interceptors, and anything else with next.
+func newGRPCWeb(s *grpc.Server, next http.Handler, cfg GRPCWebConfig) http.Handler {
+	origins := map[string]bool{}
+	for _, o := range cfg.AllowedOrigins {
+		origins[o] = true
+	}
+	ws := grpcweb.WrapServer(s,
+		grpcweb.WithOriginFunc(func(origin string) bool { return origins["*"] || origins[origin] }),
+		grpcweb.WithWebsockets(cfg.Websockets),
+		grpcweb.WithWebsocketOriginFunc(func(r *http.Request) bool {
+			return origins["*"] || origins[r.Header.Get("Origin")]
+		}),
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ws.IsGrpcWebRequest(r) || ws.IsAcceptableGrpcCorsRequest(r) || ws.IsGrpcWebSocketRequest(r) {
+			ws.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
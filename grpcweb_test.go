@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcWebFrame is a gRPC-Web frame: a message, or the trailers when the first bit of flag is set.
+type grpcWebFrame struct {
+	flag byte
+	data []byte
+}
+
+func readGRPCWebFrame(r *bufio.Reader) (*grpcWebFrame, error) {
+	hd := make([]byte, 5)
+	if _, err := io.ReadFull(r, hd); err != nil {
+		return nil, err
+	}
+	f := &grpcWebFrame{flag: hd[0], data: make([]byte, binary.BigEndian.Uint32(hd[1:]))}
+	_, err := io.ReadFull(r, f.data)
+	return f, err
+}
+
+func newGRPCWebRequest(ctx context.Context, t *testing.T, url string, m proto.Message) *http.Request {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, 5, 5+len(b))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(b)))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(append(body, b...)))
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	req.Header.Set("X-Grpc-Web", "1")
+	req.Header.Set("Origin", "http://localhost:3000")
+	return req
+}
+
+func TestGRPCWeb(t *testing.T) {
+	f := newFixture()
+	s := newGRPCServer(newServer(f.store))
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	web := httptest.NewServer(newGRPCWeb(s, next, GRPCWebConfig{Enabled: true, AllowedOrigins: []string{"http://localhost:3000"}}))
+	defer web.Close()
+
+	// unary
+	req := newGRPCWebRequest(context.Background(), t, web.URL+"/ecomm.EcommService/Products", &ProductRequest{Qty: 2})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "http://localhost:3000" {
+		t.Errorf("Access-Control-Allow-Origin: got %q", got)
+	}
+	r := bufio.NewReader(res.Body)
+	fr, err := readGRPCWebFrame(r)
+	if err != nil {
+		t.Fatalf("reading message: %v", err)
+	}
+	pr := &ProductsResponse{}
+	if err := proto.Unmarshal(fr.data, pr); err != nil || pr.Total != 4 || len(pr.Data) != 2 {
+		t.Fatalf("Products: got %v, %v", pr, err)
+	}
+	if fr, err = readGRPCWebFrame(r); err != nil || fr.flag&0x80 == 0 || !strings.Contains(string(fr.data), "grpc-status: 0") {
+		t.Fatalf("expected OK trailers, got %q, %v", fr.data, err)
+	}
+
+	// server streaming
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req = newGRPCWebRequest(ctx, t, web.URL+"/grpc.health.v1.Health/Watch", &healthpb.HealthCheckRequest{})
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	r = bufio.NewReader(res.Body)
+	for _, want := range []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING} {
+		if fr, err = readGRPCWebFrame(r); err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		hr := &healthpb.HealthCheckResponse{}
+		if err := proto.Unmarshal(fr.data, hr); err != nil || hr.Status != want {
+			t.Fatalf("Watch: got %v, %v, want %v", hr, err, want)
+		}
+		hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+
+	// CORS pre-flight
+	for origin, allowed := range map[string]bool{"http://localhost:3000": true, "http://evil.example": false} {
+		req, _ := http.NewRequest(http.MethodOptions, web.URL+"/ecomm.EcommService/Products", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "x-grpc-web,content-type")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := res.Header.Get("Access-Control-Allow-Origin") == origin; got != allowed {
+			t.Errorf("pre-flight from %v: allowed %v, want %v", origin, got, allowed)
+		}
+	}
+
+	// anything else
+	res, err = http.Get(web.URL + "/v1/products")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTeapot {
+		t.Errorf("non gRPC-Web request: got status %v", res.StatusCode)
+	}
+}
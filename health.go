@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	healthCheckTimeout    = 3 * time.Second
+	ecommService          = "ecomm.EcommService"
+)
+
+// healthCheck is a dependency check, reported as its own service in grpc.health.v1.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthChecker runs the dependency checks and sets the status of each one, of the
+// EcommService and of the server (""), that are only SERVING when every check passes.
+type healthChecker struct {
+	hs     *health.Server
+	checks []healthCheck
+
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+// newHealthChecker starts with every service NOT_SERVING until the first run.
+func newHealthChecker(hs *health.Server, checks ...healthCheck) *healthChecker {
+	h := &healthChecker{hs: hs, checks: checks, errs: map[string]error{}}
+	for _, c := range checks {
+		hs.SetServingStatus(c.name, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	hs.SetServingStatus(ecommService, healthpb.HealthCheckResponse_NOT_SERVING)
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+// run checks the dependencies every interval until the context is done.
+func (h *healthChecker) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		h.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (h *healthChecker) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			h.report(c.name, c.check(cctx))
+		}(c)
+	}
+	wg.Wait()
+
+	all := healthpb.HealthCheckResponse_SERVING
+	h.mu.Lock()
+	for _, err := range h.errs {
+		if err != nil {
+			all = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	h.mu.Unlock()
+	h.hs.SetServingStatus(ecommService, all)
+	h.hs.SetServingStatus("", all)
+}
+
+func (h *healthChecker) report(name string, err error) {
+	h.mu.Lock()
+	prev, seen := h.errs[name]
+	h.errs[name] = err
+	h.mu.Unlock()
+	if err != nil {
+		if !seen || prev == nil {
+			logger.Warn("Health check failing", zap.String("check", name), zap.Error(err))
+		}
+		h.hs.SetServingStatus(name, healthpb.HealthCheckResponse_NOT_SERVING)
+		return
+	}
+	if seen && prev != nil {
+		logger.Info("Health check recovered", zap.String("check", name))
+	}
+	h.hs.SetServingStatus(name, healthpb.HealthCheckResponse_SERVING)
+}
+
+func mongoCheck(client *mongo.Client) healthCheck {
+	return healthCheck{name: "mongo", check: func(ctx context.Context) error {
+		return client.Ping(ctx, readpref.Primary())
+	}}
+}
+
+// keycloakCheck only needs Keycloak to answer: the userinfo endpoint without a token is a 401.
+func keycloakCheck(kcu string) healthCheck {
+	return healthCheck{name: "keycloak", check: func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, kcu, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("keycloak answered %v", res.Status)
+		}
+		return nil
+	}}
+}
+
+func workersCheck(w *workerGroup) healthCheck {
+	return healthCheck{name: "workers", check: func(ctx context.Context) error {
+		return w.Err()
+	}}
+}
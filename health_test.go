@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthChecker(t *testing.T) {
+	hs := health.NewServer()
+	var mongoErr error
+	hc := newHealthChecker(hs,
+		healthCheck{name: "mongo", check: func(ctx context.Context) error { return mongoErr }},
+		workersCheck(newWorkerGroup()),
+	)
+	status := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		res, err := hs.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("Check(%q): %v", service, err)
+		}
+		return res.Status
+	}
+	if s := status(""); s != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("before the first check got %v, want NOT_SERVING", s)
+	}
+
+	hc.checkAll(context.Background())
+	for _, svc := range []string{"", ecommService, "mongo", "workers"} {
+		if s := status(svc); s != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("%q got %v, want SERVING", svc, s)
+		}
+	}
+
+	mongoErr = errors.New("no reachable servers")
+	hc.checkAll(context.Background())
+	for svc, want := range map[string]healthpb.HealthCheckResponse_ServingStatus{
+		"":           healthpb.HealthCheckResponse_NOT_SERVING,
+		ecommService: healthpb.HealthCheckResponse_NOT_SERVING,
+		"mongo":      healthpb.HealthCheckResponse_NOT_SERVING,
+		"workers":    healthpb.HealthCheckResponse_SERVING,
+	} {
+		if s := status(svc); s != want {
+			t.Errorf("%q got %v, want %v", svc, s, want)
+		}
+	}
+}
+
+func TestKeycloakCheck(t *testing.T) {
+	code := http.StatusUnauthorized
+	kc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	defer kc.Close()
+
+	c := keycloakCheck(kc.URL)
+	if err := c.check(context.Background()); err != nil {
+		t.Errorf("401 should be reachable, got %v", err)
+	}
+	code = http.StatusBadGateway
+	if err := c.check(context.Background()); err == nil {
+		t.Error("502 should fail")
+	}
+}
+
+func TestWorkersCheck(t *testing.T) {
+	w := newWorkerGroup()
+	w.Go(func(ctx context.Context) { panic("boom") })
+	w.wg.Wait()
+	if err := workersCheck(w).check(context.Background()); err == nil {
+		t.Error("a panicked worker should fail the check")
+	}
+}
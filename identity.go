@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultKeycloakTimeout         = 3 * time.Second
+	defaultKeycloakRetries         = 2
+	defaultKeycloakRetryBackoff    = 100 * time.Millisecond
+	defaultKeycloakBreakerFailures = 5
+	defaultKeycloakBreakerCooldown = 30 * time.Second
+	defaultKeycloakCacheTTL        = 30 * time.Second
+	maxIdentityCacheSize           = 100000
+	// maxUserInfoSize bounds the userinfo responses read.
+	maxUserInfoSize = 1 << 20
+)
+
+var (
+	// ErrInvalidToken is a token Keycloak rejected: expired, revoked or without the openid scope.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrIdentityUnavailable is Keycloak down, failing or too slow, or the circuit breaker open.
+	ErrIdentityUnavailable = errors.New("identity provider unavailable")
+)
+
+// identityClient calls the Keycloak userinfo endpoint with a timeout, retrying the
+// failures with a jittered backoff behind a circuit breaker, and caches the users of
+// the valid tokens for a short time.
+type identityClient struct {
+	cfg     KeycloakConfig
+	client  *http.Client
+	breaker *circuitBreaker
+
+	mu    sync.Mutex
+	cache map[string]cachedIdentity
+	now   func() time.Time
+}
+
+type cachedIdentity struct {
+	user    *Body
+	expires time.Time
+}
+
+func newIdentityClient(cfg KeycloakConfig) *identityClient {
+	return &identityClient{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+			Transport: otelhttp.NewTransport(http.DefaultTransport,
+				otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return "keycloak " + r.Method }),
+			),
+		},
+		breaker: newCircuitBreaker(cfg.BreakerFailures, cfg.BreakerCooldown),
+		cache:   map[string]cachedIdentity{},
+		now:     time.Now,
+	}
+}
+
+// UserInfo returns the user of the token. It returns ErrInvalidToken when Keycloak
+// rejects the token and ErrIdentityUnavailable when Keycloak cannot answer.
+func (c *identityClient) UserInfo(ctx context.Context, token string) (*Body, error) {
+	if u, ok := c.cached(token); ok {
+		return u, nil
+	}
+	var err error
+	for attempt := 0; attempt <= c.cfg.Retries; attempt++ {
+		if attempt > 0 {
+			if err := c.sleep(ctx, attempt); err != nil {
+				return nil, err
+			}
+		}
+		if !c.breaker.allow() {
+			return nil, fmt.Errorf("%w: circuit breaker open", ErrIdentityUnavailable)
+		}
+		var u *Body
+		var retry bool
+		u, retry, err = c.userInfo(ctx, token)
+		if !retry {
+			// the rejected tokens and the bad requests are answers, Keycloak is up
+			c.breaker.success()
+			if err != nil {
+				return nil, err
+			}
+			c.store(token, u)
+			return u, nil
+		}
+		if ctx.Err() != nil {
+			// the caller gave up, it tells nothing about Keycloak
+			c.breaker.release()
+			return nil, ctx.Err()
+		}
+		if c.breaker.failure() {
+			ctxLogger(ctx).Error("Keycloak circuit breaker open", zap.Error(err), zap.Duration("cooldown", c.cfg.BreakerCooldown))
+		}
+		ctxLogger(ctx).Warn("Keycloak call failed", zap.Int("attempt", attempt+1), zap.Error(err))
+	}
+	return nil, fmt.Errorf("%w: %v", ErrIdentityUnavailable, err)
+}
+
+// userInfo makes one call, retry tells if the error is worth another try.
+func (c *identityClient) userInfo(ctx context.Context, token string) (_ *Body, retry bool, _ error) {
+	data := url.Values{}
+	data.Set("access_token", token)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, maxUserInfoSize))
+		res.Body.Close()
+	}()
+	switch {
+	case res.StatusCode == http.StatusOK:
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		return nil, false, fmt.Errorf("%w: keycloak answered %v", ErrInvalidToken, res.Status)
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError:
+		return nil, true, fmt.Errorf("keycloak answered %v", res.Status)
+	default:
+		return nil, false, fmt.Errorf("keycloak answered %v", res.Status)
+	}
+	u := &Body{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxUserInfoSize)).Decode(u); err != nil {
+		return nil, false, fmt.Errorf("decoding the keycloak userinfo: %v", err)
+	}
+	if u.Sub == "" {
+		return nil, false, errors.New("keycloak userinfo without sub")
+	}
+	return u, false, nil
+}
+
+// sleep waits a random time up to the backoff doubled at each attempt, the "full
+// jitter" that keeps the instances from retrying all at the same time.
+func (c *identityClient) sleep(ctx context.Context, attempt int) error {
+	d := c.cfg.RetryBackoff << uint(attempt-1)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(d)) + 1))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (c *identityClient) cached(token string) (*Body, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ci, ok := c.cache[tokenHash(token)]
+	if !ok || !c.now().Before(ci.expires) {
+		return nil, false
+	}
+	return ci.user, true
+}
+
+func (c *identityClient) store(token string, u *Body) {
+	if c.cfg.CacheTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.cache) >= maxIdentityCacheSize {
+		for k, ci := range c.cache {
+			if !now.Before(ci.expires) {
+				delete(c.cache, k)
+			}
+		}
+		if len(c.cache) >= maxIdentityCacheSize {
+			return
+		}
+	}
+	c.cache[tokenHash(token)] = cachedIdentity{user: u, expires: now.Add(c.cfg.CacheTTL)}
+}
+
+// identityError converts an error of the identity client to a gRPC status.
+func identityError(ctx context.Context, err error) error {
+	if errors.Is(err, ErrIdentityUnavailable) {
+		return status.Errorf(codes.Unavailable, "Identity provider unavailable, retry later")
+	}
+	return storeError(ctx, err)
+}
+
+// circuitBreaker opens after failures calls in a row failed, failing fast for the
+// cooldown, then lets one call through to check if the service is back.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	failed    int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(failures int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{failures: failures, cooldown: cooldown, now: time.Now}
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures <= 0 || b.failed < b.failures {
+		return true
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failed, b.probing = 0, false
+}
+
+// release ends the call without a result, letting another call probe the half-open breaker.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// failure records a failed call, returning true when it opens the breaker.
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failed++
+	b.probing = false
+	if b.failures <= 0 || b.failed < b.failures {
+		return false
+	}
+	b.openUntil = b.now().Add(b.cooldown)
+	return true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// newTestIdentity answers the userinfo calls with the handler, counting them.
+func newTestIdentity(t *testing.T, cfg KeycloakConfig, h http.HandlerFunc) (*identityClient, *int32) {
+	calls := new(int32)
+	kc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		h(w, r)
+	}))
+	t.Cleanup(kc.Close)
+	cfg.URL = kc.URL
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Second
+	}
+	cfg.RetryBackoff = time.Millisecond
+	return newIdentityClient(cfg), calls
+}
+
+func answer(code int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		json.NewEncoder(w).Encode(&Body{Sub: "user-1", Name: "Jane Doe"})
+	}
+}
+
+func TestIdentityStatuses(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		h     http.HandlerFunc
+		err   error
+		calls int32
+	}{
+		{"ok", answer(http.StatusOK), nil, 1},
+		{"unauthorized", answer(http.StatusUnauthorized), ErrInvalidToken, 1},
+		{"forbidden", answer(http.StatusForbidden), ErrInvalidToken, 1},
+		{"bad request", answer(http.StatusBadRequest), errors.New("any"), 1},
+		{"server error", answer(http.StatusInternalServerError), ErrIdentityUnavailable, 3},
+		{"too many requests", answer(http.StatusTooManyRequests), ErrIdentityUnavailable, 3},
+		{"bad json", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("<html>")) }, errors.New("any"), 1},
+		{"no sub", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("{}")) }, errors.New("any"), 1},
+		{"timeout", func(w http.ResponseWriter, r *http.Request) { time.Sleep(100 * time.Millisecond) }, ErrIdentityUnavailable, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, calls := newTestIdentity(t, KeycloakConfig{Retries: 2, Timeout: 50 * time.Millisecond}, tt.h)
+			u, err := c.UserInfo(context.Background(), "token")
+			switch {
+			case tt.err == nil && (err != nil || u.Sub != "user-1"):
+				t.Errorf("got %v %v, want user-1", u, err)
+			case tt.err != nil && err == nil:
+				t.Errorf("got %v, want an error", u)
+			case tt.err == ErrInvalidToken || tt.err == ErrIdentityUnavailable:
+				if !errors.Is(err, tt.err) {
+					t.Errorf("got %v, want %v", err, tt.err)
+				}
+			case err != nil && (errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrIdentityUnavailable)):
+				t.Errorf("got %v, want another error", err)
+			}
+			if n := atomic.LoadInt32(calls); n != tt.calls {
+				t.Errorf("got %v calls, want %v", n, tt.calls)
+			}
+		})
+	}
+}
+
+func TestIdentityRetryAndCache(t *testing.T) {
+	fail := int32(1)
+	c, calls := newTestIdentity(t, KeycloakConfig{Retries: 2, CacheTTL: time.Minute}, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fail, -1) >= 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		answer(http.StatusOK)(w, r)
+	})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if u, err := c.UserInfo(context.Background(), "token"); err != nil || u.Sub != "user-1" {
+			t.Fatalf("UserInfo: got %v %v", u, err)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Fatalf("got %v calls, want the retry and no call for the cached token", n)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err := c.UserInfo(context.Background(), "token"); err != nil {
+		t.Fatalf("UserInfo: %v", err)
+	}
+	if n := atomic.LoadInt32(calls); n != 3 {
+		t.Fatalf("got %v calls, want the expired token checked again", n)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	code := int32(http.StatusServiceUnavailable)
+	c, calls := newTestIdentity(t, KeycloakConfig{BreakerFailures: 2, BreakerCooldown: time.Minute}, func(w http.ResponseWriter, r *http.Request) {
+		answer(int(atomic.LoadInt32(&code)))(w, r)
+	})
+	now := time.Now()
+	c.breaker.now = func() time.Time { return now }
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := c.UserInfo(ctx, "token"); !errors.Is(err, ErrIdentityUnavailable) {
+			t.Fatalf("UserInfo: got %v, want unavailable", err)
+		}
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Fatalf("got %v calls, want the open breaker to fail fast", n)
+	}
+
+	// after the cooldown a failed probe opens it again, a good one closes it
+	now = now.Add(2 * time.Minute)
+	c.UserInfo(ctx, "token")
+	c.UserInfo(ctx, "token")
+	if n := atomic.LoadInt32(calls); n != 3 {
+		t.Fatalf("got %v calls, want one probe", n)
+	}
+	now = now.Add(2 * time.Minute)
+	atomic.StoreInt32(&code, http.StatusUnauthorized)
+	if _, err := c.UserInfo(ctx, "token"); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("UserInfo: got %v, want invalid token", err)
+	}
+	atomic.StoreInt32(&code, http.StatusOK)
+	if _, err := c.UserInfo(ctx, "token"); err != nil {
+		t.Fatalf("UserInfo: got %v after the breaker closed", err)
+	}
+}
+
+func TestCircuitBreakerCancelledProbe(t *testing.T) {
+	code := int32(http.StatusServiceUnavailable)
+	hang := make(chan struct{})
+	c, calls := newTestIdentity(t, KeycloakConfig{BreakerFailures: 1, BreakerCooldown: time.Minute}, func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.LoadInt32(&code); n != 0 {
+			answer(int(n))(w, r)
+			return
+		}
+		<-hang
+	})
+	t.Cleanup(func() { close(hang) })
+	now := time.Now()
+	c.breaker.now = func() time.Time { return now }
+	c.UserInfo(context.Background(), "token")
+
+	// the caller gives up during the probe
+	now = now.Add(2 * time.Minute)
+	atomic.StoreInt32(&code, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.UserInfo(ctx, "token"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("UserInfo: got %v, want the deadline", err)
+	}
+	atomic.StoreInt32(&code, http.StatusOK)
+	if _, err := c.UserInfo(context.Background(), "token"); err != nil {
+		t.Fatalf("UserInfo: got %v, want another probe", err)
+	}
+	if n := atomic.LoadInt32(calls); n != 3 {
+		t.Fatalf("got %v calls, want 3", n)
+	}
+}
+
+func TestCheckoutIdentityUnavailable(t *testing.T) {
+	f, cl := newTestClient(t, func(s *server) {
+		s.identity, _ = newTestIdentity(t, KeycloakConfig{}, answer(http.StatusInternalServerError))
+	})
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "valid")
+	_, err := cl.Checkout(ctx, &CheckoutRequest{Cart: []*CheckoutRequest_Cart{
+		{Product: &Product{Id: f.vtm.ID.Hex()}, Qty: 1},
+	}})
+	assertCode(t, err, codes.Unavailable)
+	if len(f.store.Orders()) != 0 {
+		t.Fatalf("unexpected orders: %v", f.store.Orders())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+type MongoTranslation struct {
+	Locale      string `bson:"locale,omitempty"`
+	Name        string `bson:"name,omitempty"`
+	Slug        string `bson:"slug,omitempty"`
+	Description string `bson:"description,omitempty"`
+}
+
+var defaultLocale string
+var locales []string
+
+// setLocales sets the supported locales. The default locale is the one stored in the
+// root name, slug and description of each document.
+func setLocales(def string, ls []string) {
+	defaultLocale = def
+	locales = []string{defaultLocale}
+	for _, l := range ls {
+		if l != "" && !strings.EqualFold(l, defaultLocale) {
+			locales = append(locales, l)
+		}
+	}
+}
+
+// requestLocale picks the best supported locale from the accept-language metadata
+// and sends it back to the client in the content-language header.
+func requestLocale(ctx context.Context) string {
+	loc := defaultLocale
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if al := md.Get("accept-language"); len(al) > 0 {
+			loc = matchLocale(strings.Join(al, ","))
+		}
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("content-language", loc))
+	return loc
+}
+
+// matchLocale parses an Accept-Language value (e.g. "pt-BR,pt;q=0.9,en;q=0.8") and returns
+// the first supported locale, matching the full tag first and then only the language.
+func matchLocale(header string) string {
+	type tag struct {
+		name string
+		q    float64
+	}
+	tags := []tag{}
+	for _, p := range strings.Split(header, ",") {
+		parts := strings.Split(strings.TrimSpace(p), ";")
+		t := tag{name: strings.TrimSpace(parts[0]), q: 1}
+		for _, o := range parts[1:] {
+			o = strings.TrimSpace(o)
+			if strings.HasPrefix(o, "q=") {
+				if q, err := strconv.ParseFloat(o[2:], 64); err == nil {
+					t.q = q
+				}
+			}
+		}
+		if t.name != "" && t.name != "*" && t.q > 0 {
+			tags = append(tags, t)
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	for _, t := range tags {
+		for _, l := range locales {
+			if strings.EqualFold(t.name, l) {
+				return l
+			}
+		}
+		lang := strings.SplitN(t.name, "-", 2)[0]
+		for _, l := range locales {
+			if strings.EqualFold(lang, strings.SplitN(l, "-", 2)[0]) {
+				return l
+			}
+		}
+	}
+	return defaultLocale
+}
+
+// translate returns the fields for the locale, falling back to the default values
+// for anything that has not been translated.
+func translate(loc string, def MongoTranslation, ts []MongoTranslation) MongoTranslation {
+	if strings.EqualFold(loc, defaultLocale) {
+		return def
+	}
+	for _, t := range ts {
+		if strings.EqualFold(t.Locale, loc) {
+			if t.Name != "" {
+				def.Name = t.Name
+			}
+			if t.Slug != "" {
+				def.Slug = t.Slug
+			}
+			if t.Description != "" {
+				def.Description = t.Description
+			}
+			break
+		}
+	}
+	def.Locale = loc
+	return def
+}
+
+func (c *MongoCategories) translated(loc string) MongoTranslation {
+	return translate(loc, MongoTranslation{Name: c.Name, Slug: c.Slug, Description: c.Description}, c.Translations)
+}
+
+func (p *MongoProductsData) translated(loc string) MongoTranslation {
+	return translate(loc, MongoTranslation{Name: p.Name, Slug: p.Slug, Description: p.Description}, p.Translations)
+}
+
+// slugFilter matches a category by its default slug or by the slug of any translation.
+func slugFilter(s string) bson.D {
+	return bson.D{E{Key: "$or", Value: []bson.D{
+		{E{Key: "slug", Value: s}},
+		{E{Key: "translations.slug", Value: s}},
+	}}}
+}
+
+func hasTranslatedSlug(ts []MongoTranslation, s string) bool {
+	for _, t := range ts {
+		if t.Slug == s {
+			return true
+		}
+	}
+	return false
+}
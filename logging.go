@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const requestIDHeader = "x-request-id"
+
+// logger is replaced in main by the one of the configured level.
+var logger = zap.NewNop()
+
+// logPII logs the emails and names of the users as is, only for debugging.
+var logPII bool
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// newLogger returns a JSON logger writing to stderr from the level on.
+func newLogger(level string) (*zap.Logger, error) {
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	c := zap.NewProductionConfig()
+	c.Level = zap.NewAtomicLevelAt(l)
+	c.EncoderConfig.TimeKey = "time"
+	c.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	return c.Build()
+}
+
+// ctxLogger returns the logger with the request ID and the trace ID of the call.
+func ctxLogger(ctx context.Context) *zap.Logger {
+	l := logger
+	if id := requestID(ctx); id != "" {
+		l = l.With(zap.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With(zap.String("trace_id", sc.TraceID().String()))
+	}
+	return l
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID keeps the x-request-id of the client, or of the gateway, when it is
+// a sane one, otherwise it creates a new ID.
+func withRequestID(ctx context.Context) (context.Context, string) {
+	id := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(requestIDHeader); len(v) > 0 && validRequestID.MatchString(v[0]) {
+			id = v[0]
+		}
+	}
+	if id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	return context.WithValue(ctx, requestIDKey{}, id), id
+}
+
+// accessLogInterceptor gives the call a request ID, returned in the x-request-id
+// header, and logs its method, status and duration.
+func accessLogInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, id := withRequestID(ctx)
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, id))
+	res, err := handler(ctx, req)
+	logAccess(ctx, info.FullMethod, start, err)
+	return res, err
+}
+
+type requestIDStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestIDStream) Context() context.Context {
+	return s.ctx
+}
+
+func streamAccessLogInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, id := withRequestID(ss.Context())
+	ss.SetHeader(metadata.Pairs(requestIDHeader, id))
+	err := handler(srv, &requestIDStream{ServerStream: ss, ctx: ctx})
+	logAccess(ctx, info.FullMethod, start, err)
+	return err
+}
+
+func logAccess(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	fields := []zap.Field{
+		zap.String("method", method),
+		zap.String("code", code.String()),
+		zap.Duration("duration", time.Since(start)),
+	}
+	switch code {
+	case codes.OK:
+		ctxLogger(ctx).Info("call", fields...)
+	case codes.Internal, codes.Unknown, codes.DataLoss, codes.Unavailable, codes.DeadlineExceeded:
+		ctxLogger(ctx).Error("call", append(fields, zap.Error(err))...)
+	default:
+		ctxLogger(ctx).Warn("call", append(fields, zap.Error(err))...)
+	}
+}
+
+// email logs the address as j***@example.com unless logPII is set.
+func email(key, v string) zap.Field {
+	if logPII || v == "" {
+		return zap.String(key, v)
+	}
+	i := strings.LastIndex(v, "@")
+	if i < 1 {
+		return zap.String(key, redacted)
+	}
+	return zap.String(key, v[:1]+"***"+v[i:])
+}
+
+// pii logs the value as xxxxx unless logPII is set.
+func pii(key, v string) zap.Field {
+	if logPII || v == "" {
+		return zap.String(key, v)
+	}
+	return zap.String(key, redacted)
+}
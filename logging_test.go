@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestAccessLog(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	old := logger
+	logger = zap.New(core)
+	t.Cleanup(func() { logger = old })
+	_, cl := newTestClient(t)
+
+	var hd metadata.MD
+	ctx := metadata.AppendToOutgoingContext(context.Background(), requestIDHeader, "abc-123")
+	if _, err := cl.Products(ctx, &ProductRequest{Qty: 1}, grpc.Header(&hd)); err != nil {
+		t.Fatalf("Products: %v", err)
+	}
+	if got := hd.Get(requestIDHeader); len(got) != 1 || got[0] != "abc-123" {
+		t.Errorf("x-request-id: got %v, want abc-123", got)
+	}
+	ctx = metadata.AppendToOutgoingContext(context.Background(), requestIDHeader, "bad id!")
+	cl.Products(ctx, &ProductRequest{Qty: 0}, grpc.Header(&hd))
+	if got := hd.Get(requestIDHeader); len(got) != 1 || len(got[0]) != 32 {
+		t.Errorf("x-request-id: got %v, want a new ID", got)
+	}
+
+	entries := logs.FilterMessage("call").All()
+	if len(entries) != 2 {
+		t.Fatalf("got %d access logs, want 2", len(entries))
+	}
+	f := entries[0].ContextMap()
+	if f["method"] != "/ecomm.EcommService/Products" || f["code"] != "OK" || f["request_id"] != "abc-123" {
+		t.Errorf("unexpected access log: %v", f)
+	}
+	if f := entries[1].ContextMap(); f["code"] != "InvalidArgument" || entries[1].Level != zapcore.WarnLevel {
+		t.Errorf("unexpected access log: %v %v", entries[1].Level, f)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	tests := []struct {
+		field zap.Field
+		want  string
+	}{
+		{email("email", "jane@example.com"), "j***@example.com"},
+		{email("email", "not an email"), redacted},
+		{email("email", ""), ""},
+		{pii("name", "Jane Doe"), redacted},
+	}
+	for _, tt := range tests {
+		if tt.field.String != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.field.Key, tt.field.String, tt.want)
+		}
+	}
+
+	logPII = true
+	defer func() { logPII = false }()
+	if f := email("email", "jane@example.com"); f.String != "jane@example.com" {
+		t.Errorf("with logPII got %q", f.String)
+	}
+}
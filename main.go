@@ -2,40 +2,65 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"strings"
+	"syscall"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
 	"github.com/joho/godotenv"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	. "go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
-	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
-type server struct{}
+type server struct {
+	categories CategoryRepository
+	products   ProductRepository
+	orders     OrderRepository
+	carts      CartRepository
+	promotions PromotionRepository
+	cache      *catalogCache
+	// identity validates the tokens of the users.
+	identity *identityClient
+	// limiter is the rate limiter of the calls, nil when rate_limit is disabled.
+	limiter *rateLimiter
+	// shippingFee is the flat shipping of the orders.
+	shippingFee float64
+	// taxes computes the taxes of the carts and the orders, none without tax.rules_file.
+	taxes TaxCalculator
+	// taxDestination is the destination of the carts and the orders without one.
+	taxDestination TaxDestination
+}
 
 type MongoCategories struct {
 	ID            ObjectID               `bson:"_id,omitempty"`
 	Name          string                 `bson:"name,omitempty"`
 	Slug          string                 `bson:"slug,omitempty"`
+	Description   string                 `bson:"description,omitempty"`
+	Translations  []MongoTranslation     `bson:"translations,omitempty"`
+	Ancestors     []ObjectID             `bson:"ancestors,omitempty"`
+	Childrens     []ObjectID             `bson:"childrens,omitempty"`
 	Subcategories []*MongoCategories     `bson:"subcategories,omitempty"`
 	Parents       []*MongoCategories     `bson:"parents,omitempty"`
 	LastUpdated   *timestamppb.Timestamp `bson:"last_updated,omitempty"`
@@ -51,13 +76,17 @@ type MongoProductsMetadata struct {
 }
 
 type MongoProductsData struct {
-	ID          ObjectID               `bson:"_id,omitempty"`
-	Name        string                 `bson:"name,omitempty"`
-	Slug        string                 `bson:"slug,omitempty"`
-	Image       string                 `bson:"image,omitempty"`
-	Quantity    int32                  `bson:"quantity,omitempty"`
-	Value       float64                `bson:"value,omitempty"`
-	Category    ObjectID               `bson:"category,omitempty"`
+	ID           ObjectID           `bson:"_id,omitempty"`
+	Name         string             `bson:"name,omitempty"`
+	Slug         string             `bson:"slug,omitempty"`
+	Description  string             `bson:"description,omitempty"`
+	Translations []MongoTranslation `bson:"translations,omitempty"`
+	Image        string             `bson:"image,omitempty"`
+	Quantity     int32              `bson:"quantity,omitempty"`
+	Value        float64            `bson:"value,omitempty"`
+	Category     ObjectID           `bson:"category,omitempty"`
+	// TaxClass selects the tax rules of the product, standard when empty.
+	TaxClass    string                 `bson:"tax_class,omitempty"`
 	Cat         []MongoCategories      `bson:"cat,omitempty"`
 	LastUpdated *timestamppb.Timestamp `bson:"lastupdated,omitempty"`
 }
@@ -72,90 +101,239 @@ type Body struct {
 	Email             string `json:"email,omitempty"`
 }
 
-var products, categories *mongo.Collection
-
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	logger, _ = newLogger("info")
+	if err := godotenv.Load(".env"); err != nil && !os.IsNotExist(err) {
+		logger.Fatal("Error loading .env file", zap.Error(err))
+	}
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		logger.Fatal("Error loading configuration", zap.Error(err))
+	}
+	if logger, err = newLogger(cfg.LogLevel); err != nil {
+		log.Fatalf("Error creating logger: %v", err)
+	}
+	defer logger.Sync()
+	cfg.apply()
+	logger.Info("Configuration", zap.String("config", cfg.String()))
 
-	err := godotenv.Load(".env")
+	tp, err := newTracerProvider(context.Background(), cfg.Tracing)
 	if err != nil {
-		log.Fatalf("Error loading .env file")
+		logger.Fatal("Error starting tracing", zap.Error(err))
 	}
-	mongoUsername := os.Getenv("MONGO_USERNAME")
-	mongoPassword := os.Getenv("MONGO_PASSWORD")
-	mongoDb := os.Getenv("MONGO_DB")
 
-	mongoCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	var srv *server
+	var client *mongo.Client
+	mongoCtx, cancel := context.WithTimeout(context.Background(), cfg.Mongo.ConnectTimeout)
 	defer cancel()
+	workers := newWorkerGroup()
 
-	mongoUri := fmt.Sprintf("mongodb://%s:%s@localhost:27017", mongoUsername, mongoPassword)
-	fmt.Println("Connecting to MongoDB...")
-	client, err := mongo.Connect(mongoCtx, options.Client().ApplyURI(mongoUri))
-	if err != nil {
-		log.Fatalf("Error Starting MongoDB Client: %v", err)
-	}
+	if cfg.Store == "memory" {
+		logger.Info("Starting with the in-memory demo store")
+		m := NewMemoryStore()
+		seedDemo(m)
+		srv = newServer(m)
+	} else {
+		mongoOpts, err := cfg.Mongo.ClientOptions()
+		if err != nil {
+			logger.Fatal("Invalid MongoDB options", zap.Error(err))
+		}
+		logger.Info("Connecting to MongoDB")
+		client, err = mongo.Connect(mongoCtx, mongoOpts)
+		if err != nil {
+			logger.Fatal("Error Starting MongoDB Client", zap.Error(err))
+		}
 
-	products = client.Database(mongoDb).Collection("products")
-	categories = client.Database(mongoDb).Collection("categories")
+		store := NewMongoStore(client.Database(cfg.Mongo.Database))
+		if err := store.EnsureIndexes(mongoCtx); err != nil {
+			logger.Fatal("Error creating the MongoDB indexes", zap.Error(err))
+		}
+		srv = newServer(store)
+		watchCatalog(workers, srv.cache, store.products, store.categories)
+	}
+	srv.identity = newIdentityClient(cfg.Keycloak)
+	srv.shippingFee = cfg.ShippingFee
+	srv.taxDestination = cfg.Tax.DefaultDestination
+	if cfg.Tax.RulesFile != "" {
+		rules, err := loadTaxRules(cfg.Tax.RulesFile)
+		if err != nil {
+			logger.Fatal("Error loading the tax rules", zap.Error(err))
+		}
+		srv.taxes = rules
+	}
+	workers.Go(srv.cache.sweepExpired(time.Minute))
 
-	fmt.Println("Starting Listener...")
-	l, err := net.Listen("tcp", "0.0.0.0:50051")
+	logger.Info("Starting Listener", zap.String("addr", cfg.ListenAddr))
+	l, err := net.Listen("tcp", cfg.ListenAddr)
 	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+		logger.Fatal("Failed to listen", zap.Error(err))
+	}
+	var certs *certReloader
+	grpcOpts := []grpc.ServerOption{}
+	gatewayCreds := grpc.WithInsecure()
+	if cfg.TLS.CertFile != "" {
+		if certs, err = newCertReloader(cfg.TLS); err != nil {
+			logger.Fatal("Error loading TLS certificates", zap.Error(err))
+		}
+		workers.Go(certs.watch)
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(certs.serverTLS())))
+		gatewayCreds = grpc.WithTransportCredentials(certs.gatewayCredentials())
+	}
+	var rdb *redis.Client
+	if cfg.RateLimit.Enabled {
+		if cfg.RateLimit.Store == "redis" {
+			rdb = redis.NewClient(&redis.Options{Addr: cfg.RateLimit.RedisAddr})
+			srv.limiter = newRateLimiter(newRedisRateLimitStore(rdb), cfg.RateLimit.Default, cfg.RateLimit.Methods)
+		} else {
+			m := newMemoryRateLimitStore()
+			srv.limiter = newRateLimiter(m, cfg.RateLimit.Default, cfg.RateLimit.Methods)
+			workers.Go(srv.limiter.sweepBuckets(m, time.Minute))
+		}
+	}
+	s := newGRPCServer(srv, grpcOpts...)
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(s, hs)
+	checks := []healthCheck{workersCheck(workers)}
+	if client != nil {
+		checks = append(checks, mongoCheck(client))
 	}
-	opts := []grpc.ServerOption{}
-	s := grpc.NewServer(opts...)
-	RegisterEcommServiceServer(s, &server{})
+	if cfg.Keycloak.URL != "" {
+		checks = append(checks, keycloakCheck(cfg.Keycloak.URL))
+	}
+	hc := newHealthChecker(hs, checks...)
+	workers.Go(func(ctx context.Context) { hc.run(ctx, cfg.HealthInterval) })
 
 	go func() {
-		fmt.Println("Ecomm Server Started...")
+		logger.Info("Ecomm Server Started", zap.Bool("tls", certs != nil), zap.String("client_auth", cfg.TLS.ClientAuth))
 		if err := s.Serve(l); err != nil {
-			log.Fatalf("Failed to start server: %v", err)
+			logger.Fatal("Failed to start server", zap.Error(err))
 		}
 	}()
 
+	var web *http.Server
+	gwCtx, stopGateway := context.WithCancel(context.Background())
+	defer stopGateway()
+	if cfg.HTTPAddr != "" {
+		h, err := newGateway(gwCtx, l.Addr().String(), gatewayCreds)
+		if err != nil {
+			logger.Fatal("Failed to start gateway", zap.Error(err))
+		}
+		if cfg.GRPCWeb.Enabled {
+			h = newGRPCWeb(s, h, cfg.GRPCWeb)
+		}
+		web = &http.Server{Addr: cfg.HTTPAddr, Handler: h}
+		go func() {
+			logger.Info("REST Gateway and gRPC-Web Started", zap.String("addr", cfg.HTTPAddr), zap.Bool("tls", certs != nil))
+			var err error
+			if certs != nil {
+				web.TLSConfig = certs.serverTLS()
+				err = web.ListenAndServeTLS("", "")
+			} else {
+				err = web.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				logger.Fatal("Failed to start HTTP server", zap.Error(err))
+			}
+		}()
+	}
+
+	var metrics *http.Server
+	if cfg.MetricsAddr != "" {
+		prometheus.MustRegister(newCacheCollector(srv.cache))
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		metrics = &http.Server{Addr: cfg.MetricsAddr, Handler: mux}
+		go func() {
+			logger.Info("Metrics Started", zap.String("addr", cfg.MetricsAddr))
+			if err := metrics.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatal("Failed to start metrics server", zap.Error(err))
+			}
+		}()
+	}
+
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
-
-	<-ch
-	fmt.Println("Stopping Ecomm Server...")
-	s.Stop()
-	fmt.Println("Closing Listener...")
-	l.Close()
-	fmt.Println("Closing MongoDB...")
-	client.Disconnect(mongoCtx)
-	fmt.Println("All done!")
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-ch
+	logger.Info("Stopping Ecomm Server", zap.Stringer("signal", sig))
+	hs.Shutdown()
+	if web != nil {
+		webShutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		if err := web.Shutdown(webShutdownCtx); err != nil {
+			web.Close()
+		}
+		cancel()
+		stopGateway()
+	}
+	if !gracefulStop(s, cfg.ShutdownTimeout) {
+		logger.Warn("Drain deadline exceeded, in-flight calls were stopped")
+	}
+	logger.Info("Stopping Background Workers")
+	if !workers.Stop(cfg.ShutdownTimeout) {
+		logger.Warn("Background workers did not stop in time")
+	}
+	logger.Info("Cache stats", zap.Any("stats", srv.cache.Stats()))
+	if tp != nil {
+		tpShutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		if err := tp.Shutdown(tpShutdownCtx); err != nil {
+			logger.Error("Error flushing traces", zap.Error(err))
+		}
+		cancel()
+	}
+	if client != nil {
+		logger.Info("Closing MongoDB")
+		disconnectCtx, cancel := context.WithTimeout(context.Background(), cfg.Mongo.ConnectTimeout)
+		defer cancel()
+		if err := client.Disconnect(disconnectCtx); err != nil {
+			logger.Error("Error closing MongoDB", zap.Error(err))
+		}
+	}
+	if rdb != nil {
+		rdb.Close()
+	}
+	if metrics != nil {
+		metrics.Close()
+	}
+	logger.Info("All done")
 }
 
-func (*server) CategoriesMenu(ctx context.Context, req *emptypb.Empty) (*CategoriesMenuResponse, error) {
-	log.Println("CategoriesMenu called")
-	matchStage := bson.D{E{Key: "$match", Value: bson.D{
-		E{Key: "ancestors", Value: nil},
-	}}}
-	graphLookupStage := bson.D{
-		E{Key: "$graphLookup", Value: bson.D{
-			E{Key: "from", Value: "categories"},
-			E{Key: "startWith", Value: "$childrens"},
-			E{Key: "connectFromField", Value: "childrens"},
-			E{Key: "connectToField", Value: "_id"},
-			E{Key: "maxDepth", Value: 0},
-			E{Key: "as", Value: "subcategories"},
-		}}}
-	cur, err := categories.Aggregate(context.Background(), mongo.Pipeline{matchStage, graphLookupStage})
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
+// newGRPCServer returns the gRPC server with the interceptors and the EcommService registered,
+// extra are added options like the TLS credentials.
+func newGRPCServer(srv *server, extra ...grpc.ServerOption) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(), accessLogInterceptor, metricsInterceptor, srv.rateLimitInterceptor, recoveryInterceptor, deadlineInterceptor, validationInterceptor, conditionalInterceptor),
+		grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(), streamAccessLogInterceptor, streamMetricsInterceptor, streamRecoveryInterceptor),
 	}
-	defer cur.Close(context.Background())
-	ds := []*MongoCategories{}
-	for cur.Next(context.Background()) {
-		d := &MongoCategories{}
-		if err := cur.Decode(d); err != nil {
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Cannot decoding data: %v", err))
-		}
-		ds = append(ds, d)
+	s := grpc.NewServer(append(opts, extra...)...)
+	RegisterEcommServiceServer(s, srv)
+	return s
+}
+
+// newServer returns the server of the store, with the default Keycloak client, without
+// rate limits, shipping or taxes; main sets them from the configuration.
+func newServer(s Store) *server {
+	return &server{
+		categories: s,
+		products:   s,
+		orders:     s,
+		carts:      s,
+		promotions: s,
+		cache:      newCatalogCache(cacheTTL),
+		identity:   newIdentityClient(defaultConfig().Keycloak),
+		taxes:      noTaxes{},
 	}
-	if err = cur.Err(); err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
+}
+
+func (srv *server) CategoriesMenu(ctx context.Context, req *CategoriesMenuRequest) (*CategoriesMenuResponse, error) {
+	ctxLogger(ctx).Debug("CategoriesMenu called", zap.Bool("include_counts", req.GetIncludeCounts()))
+	loc := requestLocale(ctx)
+	key := fmt.Sprintf("menu|%v|%v", loc, req.GetIncludeCounts())
+	if c, ok := srv.cache.get(key); ok {
+		return c.(*CategoriesMenuResponse), nil
+	}
+	ds, err := srv.categories.RootCategories(ctx)
+	if err != nil {
+		return nil, storeError(ctx, err)
 	}
 
 	res := []*Category{}
@@ -163,58 +341,53 @@ func (*server) CategoriesMenu(ctx context.Context, req *emptypb.Empty) (*Categor
 		ccs := []*Category{}
 		if len(d.Subcategories) > 0 {
 			for _, cc := range d.Subcategories {
+				t := cc.translated(loc)
 				ec := &Category{
 					Id:   cc.ID.Hex(),
-					Name: cc.Name,
-					Slug: cc.Slug,
+					Name: t.Name,
+					Slug: t.Slug,
 				}
 				ccs = append(ccs, ec)
 			}
 		}
+		t := d.translated(loc)
 		r := &Category{
 			Id:          d.ID.Hex(),
-			Name:        d.Name,
-			Slug:        d.Slug,
+			Name:        t.Name,
+			Slug:        t.Slug,
+			Description: t.Description,
 			Childrens:   ccs,
 			LastUpdated: d.LastUpdated,
 		}
 		res = append(res, r)
 	}
-	return &CategoriesMenuResponse{
+	if req.GetIncludeCounts() {
+		counts, err := srv.loadCounts(ctx)
+		if err != nil {
+			return nil, storeError(ctx, err)
+		}
+		for _, r := range res {
+			withCounts(r, counts)
+		}
+	}
+	resp := &CategoriesMenuResponse{
 		Categories: res,
-	}, nil
+	}
+	srv.cache.set(key, resp)
+	return resp, nil
 }
 
-func (*server) CategoryBreadcrumb(ctx context.Context, req *CategoryRequest) (*CategoriesMenuResponse, error) {
+func (srv *server) CategoryBreadcrumb(ctx context.Context, req *CategoryRequest) (*CategoriesMenuResponse, error) {
 	s := req.GetSlug()
-	log.Printf("CategoryBreadcrumb called with slug: %v\n", s)
-	matchStage := bson.D{E{Key: "$match", Value: bson.D{
-		E{Key: "slug", Value: s},
-	}}}
-	graphLookupStage := bson.D{
-		E{Key: "$graphLookup", Value: bson.D{
-			E{Key: "from", Value: "categories"},
-			E{Key: "startWith", Value: "$ancestors"},
-			E{Key: "connectFromField", Value: "ancestors"},
-			E{Key: "connectToField", Value: "_id"},
-			E{Key: "maxDepth", Value: 0},
-			E{Key: "as", Value: "parents"},
-		}}}
-	cur, err := categories.Aggregate(context.Background(), mongo.Pipeline{matchStage, graphLookupStage})
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
+	ctxLogger(ctx).Debug("CategoryBreadcrumb called", zap.String("slug", s))
+	loc := requestLocale(ctx)
+	key := fmt.Sprintf("breadcrumb|%v|%v", s, loc)
+	if c, ok := srv.cache.get(key); ok {
+		return c.(*CategoriesMenuResponse), nil
 	}
-	defer cur.Close(context.Background())
-	ds := []*MongoCategories{}
-	for cur.Next(context.Background()) {
-		d := &MongoCategories{}
-		if err := cur.Decode(d); err != nil {
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Cannot decoding data: %v", err))
-		}
-		ds = append(ds, d)
-	}
-	if err = cur.Err(); err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
+	ds, err := srv.categories.CategoriesBySlug(ctx, s)
+	if err != nil {
+		return nil, storeError(ctx, err)
 	}
 
 	res := []*Category{}
@@ -222,58 +395,47 @@ func (*server) CategoryBreadcrumb(ctx context.Context, req *CategoryRequest) (*C
 		cps := []*Category{}
 		if len(d.Parents) > 0 {
 			for _, cp := range d.Parents {
+				t := cp.translated(loc)
 				ec := &Category{
 					Id:   cp.ID.Hex(),
-					Name: cp.Name,
-					Slug: cp.Slug,
+					Name: t.Name,
+					Slug: t.Slug,
 				}
 				cps = append(cps, ec)
 			}
 		}
+		t := d.translated(loc)
 		r := &Category{
 			Id:          d.ID.Hex(),
-			Name:        d.Name,
-			Slug:        d.Slug,
+			Name:        t.Name,
+			Slug:        t.Slug,
+			Description: t.Description,
 			Ancestors:   cps,
 			LastUpdated: d.LastUpdated,
 		}
 		res = append(res, r)
 	}
-	return &CategoriesMenuResponse{
+	resp := &CategoriesMenuResponse{
 		Categories: res,
-	}, nil
+	}
+	// not the unknown slugs, every slug tried would be kept
+	if len(res) > 0 {
+		srv.cache.set(key, resp)
+	}
+	return resp, nil
 }
 
-func (*server) CategoriesSideMenu(ctx context.Context, req *CategoryRequest) (*CategoriesMenuResponse, error) {
+func (srv *server) CategoriesSideMenu(ctx context.Context, req *CategoryRequest) (*CategoriesMenuResponse, error) {
 	s := req.GetSlug()
-	log.Printf("CategoriesSideMenu called with slug: %v\n", s)
-	matchStage := bson.D{E{Key: "$match", Value: bson.D{
-		E{Key: "slug", Value: s},
-	}}}
-	graphLookupStage := bson.D{
-		E{Key: "$graphLookup", Value: bson.D{
-			E{Key: "from", Value: "categories"},
-			E{Key: "startWith", Value: "$childrens"},
-			E{Key: "connectFromField", Value: "childrens"},
-			E{Key: "connectToField", Value: "_id"},
-			E{Key: "maxDepth", Value: 0},
-			E{Key: "as", Value: "subcategories"},
-		}}}
-	cur, err := categories.Aggregate(context.Background(), mongo.Pipeline{matchStage, graphLookupStage})
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
-	}
-	defer cur.Close(context.Background())
-	ds := []*MongoCategories{}
-	for cur.Next(context.Background()) {
-		d := &MongoCategories{}
-		if err := cur.Decode(d); err != nil {
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Cannot decoding data: %v", err))
-		}
-		ds = append(ds, d)
+	ctxLogger(ctx).Debug("CategoriesSideMenu called", zap.String("slug", s))
+	loc := requestLocale(ctx)
+	key := fmt.Sprintf("sidemenu|%v|%v|%v", s, loc, req.GetIncludeCounts())
+	if c, ok := srv.cache.get(key); ok {
+		return c.(*CategoriesMenuResponse), nil
 	}
-	if err = cur.Err(); err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
+	ds, err := srv.categories.CategoriesBySlug(ctx, s)
+	if err != nil {
+		return nil, storeError(ctx, err)
 	}
 
 	res := []*Category{}
@@ -281,274 +443,445 @@ func (*server) CategoriesSideMenu(ctx context.Context, req *CategoryRequest) (*C
 		ccs := []*Category{}
 		if len(d.Subcategories) > 0 {
 			for _, cc := range d.Subcategories {
+				t := cc.translated(loc)
 				ec := &Category{
 					Id:   cc.ID.Hex(),
-					Name: cc.Name,
-					Slug: cc.Slug,
+					Name: t.Name,
+					Slug: t.Slug,
 				}
 				ccs = append(ccs, ec)
 			}
 		}
+		t := d.translated(loc)
 		r := &Category{
 			Id:          d.ID.Hex(),
-			Name:        d.Name,
-			Slug:        d.Slug,
+			Name:        t.Name,
+			Slug:        t.Slug,
+			Description: t.Description,
 			Childrens:   ccs,
 			LastUpdated: d.LastUpdated,
 		}
 		res = append(res, r)
 	}
-	return &CategoriesMenuResponse{
+	if req.GetIncludeCounts() {
+		counts, err := srv.loadCounts(ctx)
+		if err != nil {
+			return nil, storeError(ctx, err)
+		}
+		for _, r := range res {
+			withCounts(r, counts)
+		}
+	}
+	resp := &CategoriesMenuResponse{
 		Categories: res,
-	}, nil
+	}
+	// not the unknown slugs, every slug tried would be kept
+	if len(res) > 0 {
+		srv.cache.set(key, resp)
+	}
+	return resp, nil
 }
 
-func dataToProd(p MongoProductsData) *Product {
-	return &Product{
-		Id:       p.ID.Hex(),
-		Name:     p.Name,
-		Slug:     p.Slug,
-		Image:    p.Image,
-		Quantity: p.Quantity,
-		Value:    float32(math.Ceil(p.Value*100) / 100),
-		Category: &Category{
-			Id:   p.Cat[0].ID.Hex(),
-			Name: p.Cat[0].Name,
-			Slug: p.Cat[0].Slug,
-		},
+func (srv *server) CategoryTree(ctx context.Context, req *CategoryTreeRequest) (*CategoriesMenuResponse, error) {
+	s := req.GetSlug()
+	depth := req.GetDepth()
+	ctxLogger(ctx).Debug("CategoryTree called", zap.String("slug", s), zap.Int32("depth", depth))
+	if depth < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Depth cannot be negative")
+	}
+	loc := requestLocale(ctx)
+	key := fmt.Sprintf("tree|%v|%v|%v", s, depth, loc)
+	if c, ok := srv.cache.get(key); ok {
+		return c.(*CategoriesMenuResponse), nil
+	}
+	ds, err := srv.categories.AllCategories(ctx)
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+
+	byID := map[ObjectID]*MongoCategories{}
+	for _, d := range ds {
+		byID[d.ID] = d
+	}
+	roots := []*MongoCategories{}
+	for _, d := range ds {
+		if s == "" && len(d.Ancestors) == 0 {
+			roots = append(roots, d)
+		}
+		if s != "" && (d.Slug == s || hasTranslatedSlug(d.Translations, s)) {
+			roots = append(roots, d)
+		}
+	}
+	if s != "" && len(roots) == 0 {
+		return nil, status.Errorf(codes.NotFound, fmt.Sprintf("Category not found: %v", s))
+	}
+
+	res := []*Category{}
+	for _, d := range roots {
+		levels := depth
+		if depth == 0 {
+			levels = -1
+		}
+		res = append(res, categoryTree(d, byID, loc, levels, map[ObjectID]bool{}))
+	}
+	resp := &CategoriesMenuResponse{
+		Categories: res,
+	}
+	srv.cache.set(key, resp)
+	return resp, nil
+}
+
+// categoryTree builds the nested category following the childrens ids, with levels
+// levels of children below it, every level when levels is negative.
+func categoryTree(d *MongoCategories, byID map[ObjectID]*MongoCategories, loc string, levels int32, seen map[ObjectID]bool) *Category {
+	seen[d.ID] = true
+	t := d.translated(loc)
+	r := &Category{
+		Id:          d.ID.Hex(),
+		Name:        t.Name,
+		Slug:        t.Slug,
+		Description: t.Description,
+		Childrens:   []*Category{},
+		LastUpdated: d.LastUpdated,
+	}
+	if levels == 0 {
+		return r
+	}
+	for _, id := range d.Childrens {
+		c, ok := byID[id]
+		if !ok || seen[id] {
+			continue
+		}
+		next := levels - 1
+		if levels < 0 {
+			next = levels
+		}
+		r.Childrens = append(r.Childrens, categoryTree(c, byID, loc, next, seen))
+	}
+	return r
+}
+
+func dataToProd(p MongoProductsData, loc string) *Product {
+	t := p.translated(loc)
+	res := &Product{
+		Id:          p.ID.Hex(),
+		Name:        t.Name,
+		Slug:        t.Slug,
+		Description: t.Description,
+		Image:       p.Image,
+		Quantity:    p.Quantity,
+		Value:       float32(math.Ceil(p.Value*100) / 100),
 		LastUpdated: p.LastUpdated,
 	}
+	// the category can be missing when it was deleted after the product was created
+	if len(p.Cat) > 0 {
+		c := p.Cat[0].translated(loc)
+		res.Category = &Category{
+			Id:   p.Cat[0].ID.Hex(),
+			Name: c.Name,
+			Slug: c.Slug,
+		}
+	}
+	return res
 }
 
-func (*server) Products(ctx context.Context, req *ProductRequest) (*ProductsResponse, error) {
+func (srv *server) Products(ctx context.Context, req *ProductRequest) (*ProductsResponse, error) {
 	start := req.GetStart()
 	qty := req.GetQty()
-	log.Printf("Products called with start: %v | qty: %v\n", start, qty)
-	sortStage := bson.D{E{Key: "$sort", Value: bson.D{E{Key: "name", Value: 1}}}}
-	graphLookupStage := bson.D{
-		E{Key: "$graphLookup", Value: bson.D{
-			E{Key: "from", Value: "categories"},
-			E{Key: "startWith", Value: "$category"},
-			E{Key: "connectFromField", Value: "category"},
-			E{Key: "connectToField", Value: "_id"},
-			E{Key: "maxDepth", Value: 0},
-			E{Key: "as", Value: "cat"},
-		}}}
-	facetStage := bson.D{
-		E{Key: "$facet", Value: bson.D{
-			E{Key: "metadata", Value: []bson.D{{E{Key: "$count", Value: "total"}}}},
-			E{Key: "data", Value: []bson.D{{E{Key: "$skip", Value: start}}, {E{Key: "$limit", Value: qty}}}},
-		}},
-	}
-	cur, err := products.Aggregate(context.Background(), mongo.Pipeline{sortStage, graphLookupStage, facetStage})
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
-	}
-	d := &MongoProducts{}
-	defer cur.Close(context.Background())
-	for cur.Next(context.Background()) {
-		if err := cur.Decode(d); err != nil {
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Cannot decoding data: %v", err))
+	ctxLogger(ctx).Debug("Products called", zap.Int32("start", start), zap.Int32("qty", qty))
+	loc := requestLocale(ctx)
+	key := fmt.Sprintf("listing|products|%v|%v", loc, qty)
+	if start == 0 {
+		if c, ok := srv.cache.get(key); ok {
+			return c.(*ProductsResponse), nil
 		}
 	}
-	if err = cur.Err(); err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
+	d, err := srv.products.ListProducts(ctx, ProductFilter{}, start, qty)
+	if err != nil {
+		return nil, storeError(ctx, err)
 	}
 	data := []*Product{}
 	for _, p := range d.Data {
-		data = append(data, dataToProd(p))
+		data = append(data, dataToProd(p, loc))
 	}
-	return &ProductsResponse{
-		Total: d.Metadata[0].Total,
+	resp := &ProductsResponse{
+		Total: 0,
 		Data:  data,
-	}, nil
-}
-
-func seeProductCategories(oid ObjectID) []ObjectID {
-	matchStage := bson.D{E{Key: "$match", Value: bson.D{
-		E{Key: "_id", Value: oid},
-	}}}
-	graphLookupStage := bson.D{
-		E{Key: "$graphLookup", Value: bson.D{
-			E{Key: "from", Value: "categories"},
-			E{Key: "startWith", Value: "$childrens"},
-			E{Key: "connectFromField", Value: "childrens"},
-			E{Key: "connectToField", Value: "_id"},
-			E{Key: "as", Value: "subcategories"},
-		}}}
-	cur, err := categories.Aggregate(context.Background(), mongo.Pipeline{matchStage, graphLookupStage})
-	if err != nil {
-		fmt.Printf("Unknown Internal Error: %v", err)
 	}
-	defer cur.Close(context.Background())
-	ds := []*MongoCategories{}
-	for cur.Next(context.Background()) {
-		d := &MongoCategories{}
-		if err := cur.Decode(d); err != nil {
-			fmt.Printf("Cannot decoding data: %v", err)
-		}
-		ds = append(ds, d)
+	if len(d.Metadata) > 0 {
+		resp.Total = d.Metadata[0].Total
 	}
-	if err = cur.Err(); err != nil {
-		fmt.Printf("Unknown Internal Error: %v", err)
+	if start == 0 {
+		srv.cache.set(key, resp)
 	}
+	return resp, nil
+}
 
-	cats := []ObjectID{}
-	if len(ds[0].Subcategories) > 0 {
-		for _, cat := range ds[0].Subcategories {
-			cats = append(cats, cat.ID)
-		}
+// seeProductCategories returns the categories whose products are listed in the category,
+// all the subcategories below it or the category itself when it has none.
+func (srv *server) seeProductCategories(ctx context.Context, oid ObjectID) ([]ObjectID, error) {
+	key := fmt.Sprintf("descendants|%v", oid.Hex())
+	if c, ok := srv.cache.get(key); ok {
+		return c.([]ObjectID), nil
+	}
+	cats, err := srv.categories.Descendants(ctx, oid)
+	if err != nil {
+		return nil, err
 	}
-	return cats
+	if len(cats) == 0 {
+		cats = []ObjectID{oid}
+	}
+	srv.cache.set(key, cats)
+	return cats, nil
 }
 
-func (*server) ProductsFromCategory(ctx context.Context, req *ProductFromCategoryRequest) (*ProductsResponse, error) {
+func (srv *server) ProductsFromCategory(ctx context.Context, req *ProductFromCategoryRequest) (*ProductsResponse, error) {
 	categoryID := req.GetCategoryId()
 	start := req.GetStart()
 	qty := req.GetQty()
-	log.Printf("ProductsFromCategory called with Category ID: %v | start: %v | qty: %v\n", categoryID, start, qty)
+	ctxLogger(ctx).Debug("ProductsFromCategory called", zap.String("category_id", categoryID), zap.Int32("start", start), zap.Int32("qty", qty))
+	loc := requestLocale(ctx)
 	oid, err := primitive.ObjectIDFromHex(categoryID)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "Cannot parse ID")
 	}
-	cats := seeProductCategories(oid)
-	search := bson.D{}
-	if len(cats) > 0 {
-		arr := []bson.D{}
-		for _, i := range cats {
-			arr = append(arr, bson.D{E{Key: "category", Value: i}})
+	key := fmt.Sprintf("listing|category|%v|%v|%v", categoryID, loc, qty)
+	if start == 0 {
+		if c, ok := srv.cache.get(key); ok {
+			return c.(*ProductsResponse), nil
 		}
-		search = bson.D{E{Key: "$or", Value: arr}}
-	} else {
-		search = bson.D{E{Key: "category", Value: oid}}
-	}
-	matchStage := bson.D{E{Key: "$match", Value: search}}
-	sortStage := bson.D{E{Key: "$sort", Value: bson.D{E{Key: "name", Value: 1}}}}
-	graphLookupStage := bson.D{
-		E{Key: "$graphLookup", Value: bson.D{
-			E{Key: "from", Value: "categories"},
-			E{Key: "startWith", Value: "$category"},
-			E{Key: "connectFromField", Value: "category"},
-			E{Key: "connectToField", Value: "_id"},
-			E{Key: "maxDepth", Value: 0},
-			E{Key: "as", Value: "cat"},
-		}}}
-	facetStage := bson.D{
-		E{Key: "$facet", Value: bson.D{
-			E{Key: "metadata", Value: []bson.D{{E{Key: "$count", Value: "total"}}}},
-			E{Key: "data", Value: []bson.D{{E{Key: "$skip", Value: start}}, {E{Key: "$limit", Value: qty}}}},
-		}},
-	}
-	cur, err := products.Aggregate(context.Background(), mongo.Pipeline{matchStage, sortStage, graphLookupStage, facetStage})
+	}
+	cats, err := srv.seeProductCategories(ctx, oid)
+	if err == ErrCategoryNotFound {
+		return nil, status.Errorf(codes.NotFound, fmt.Sprintf("Category not found: %v", categoryID))
+	}
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
+		return nil, storeError(ctx, err)
 	}
-	d := &MongoProducts{}
-	defer cur.Close(context.Background())
-	for cur.Next(context.Background()) {
-		if err := cur.Decode(d); err != nil {
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Cannot decoding data: %v", err))
-		}
+	d, err := srv.products.ListProducts(ctx, ProductFilter{Categories: cats}, start, qty)
+	if err != nil {
+		return nil, storeError(ctx, err)
 	}
-	if err = cur.Err(); err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
+	resp := &ProductsResponse{Total: 0, Data: []*Product{}}
+	for _, p := range d.Data {
+		resp.Data = append(resp.Data, dataToProd(p, loc))
 	}
-	data := []*Product{}
-	if len(d.Data) > 0 {
-		for _, p := range d.Data {
-			data = append(data, dataToProd(p))
-		}
-		return &ProductsResponse{Total: d.Metadata[0].Total, Data: data}, nil
-	} else {
-		return &ProductsResponse{Total: 0, Data: data}, nil
+	if len(d.Metadata) > 0 {
+		resp.Total = d.Metadata[0].Total
+	}
+	if start == 0 {
+		srv.cache.set(key, resp)
 	}
+	return resp, nil
 }
 
-func (*server) SearchProducts(ctx context.Context, req *SearchProductsRequest) (*ProductsResponse, error) {
+func (srv *server) SearchProducts(ctx context.Context, req *SearchProductsRequest) (*ProductsResponse, error) {
 	name := req.GetName()
 	start := req.GetStart()
 	qty := req.GetQty()
-	log.Printf("SearchProducts called with Name: %v | start: %v | qty: %v\n", name, start, qty)
-	matchStage := bson.D{E{Key: "$match", Value: bson.D{
-		E{Key: "name", Value: Regex{Pattern: name, Options: "i"}},
-	}}}
-	sortStage := bson.D{E{Key: "$sort", Value: bson.D{E{Key: "name", Value: 1}}}}
-	graphLookupStage := bson.D{
-		E{Key: "$graphLookup", Value: bson.D{
-			E{Key: "from", Value: "categories"},
-			E{Key: "startWith", Value: "$category"},
-			E{Key: "connectFromField", Value: "category"},
-			E{Key: "connectToField", Value: "_id"},
-			E{Key: "maxDepth", Value: 0},
-			E{Key: "as", Value: "cat"},
-		}}}
-	facetStage := bson.D{
-		E{Key: "$facet", Value: bson.D{
-			E{Key: "metadata", Value: []bson.D{{E{Key: "$count", Value: "total"}}}},
-			E{Key: "data", Value: []bson.D{{E{Key: "$skip", Value: start}}, {E{Key: "$limit", Value: qty}}}},
-		}},
-	}
-	cur, err := products.Aggregate(context.Background(), mongo.Pipeline{matchStage, graphLookupStage, sortStage, facetStage})
+	ctxLogger(ctx).Debug("SearchProducts called", zap.String("name", name), zap.Int32("start", start), zap.Int32("qty", qty))
+	loc := requestLocale(ctx)
+	d, err := srv.products.ListProducts(ctx, ProductFilter{Name: name}, start, qty)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
-	}
-	d := &MongoProducts{}
-	defer cur.Close(context.Background())
-	for cur.Next(context.Background()) {
-		if err := cur.Decode(d); err != nil {
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Cannot decoding data: %v", err))
-		}
-	}
-	if err = cur.Err(); err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Unknown Internal Error: %v", err))
+		return nil, storeError(ctx, err)
 	}
 	data := []*Product{}
-	if len(d.Data) > 0 {
-		for _, p := range d.Data {
-			data = append(data, dataToProd(p))
-		}
-		return &ProductsResponse{Total: d.Metadata[0].Total, Data: data}, nil
-	} else {
+	for _, p := range d.Data {
+		data = append(data, dataToProd(p, loc))
+	}
+	if len(d.Metadata) == 0 {
 		return &ProductsResponse{Total: 0, Data: data}, nil
 	}
+	return &ProductsResponse{Total: d.Metadata[0].Total, Data: data}, nil
 }
 
-func (*server) Checkout(ctx context.Context, req *CheckoutRequest) (*wrapperspb.BoolValue, error) {
-	log.Println("Checkout called")
+func (srv *server) Checkout(ctx context.Context, req *CheckoutRequest) (*CheckoutResponse, error) {
+	checkoutAttempts.Inc()
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
 		return nil, status.Errorf(codes.InvalidArgument, "Retrieving metadata is failed")
 	}
 	token := md["x-user-auth-token"]
-	res, err := keycloak(token[0])
+	if len(token) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "Missing x-user-auth-token")
+	}
+	if (len(req.GetCart()) > 0) == (req.GetCartId() != "") {
+		return nil, status.Errorf(codes.InvalidArgument, "Either cart or cart_id is required")
+	}
+	if req.GetCartId() != "" && req.GetCouponCode() != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "The coupon of a cart is set with ApplyCoupon")
+	}
+	b, err := srv.identity.UserInfo(ctx, token[0])
+	if errors.Is(err, ErrInvalidToken) {
+		ctxLogger(ctx).Info("Checkout Unauthorized", zap.Error(err))
+		checkouts.WithLabelValues("unauthorized").Inc()
+		return &CheckoutResponse{Value: false}, nil
+	}
+	if err != nil {
+		ctxLogger(ctx).Error("Error validating the user token", zap.Error(err))
+		checkouts.WithLabelValues("failed").Inc()
+		return nil, identityError(ctx, err)
+	}
+	lines, coupon := req.GetCart(), req.GetCouponCode()
+	var dest TaxDestination
+	if d := req.GetDestination(); d != nil {
+		dest = TaxDestination{Country: d.GetCountry(), Region: d.GetRegion()}
+	}
+	var cart *MongoCart
+	if req.GetCartId() != "" {
+		if cart, lines, err = srv.checkoutCart(ctx, req.GetCartId(), b.Sub); err != nil {
+			checkouts.WithLabelValues("failed").Inc()
+			return nil, err
+		}
+		coupon = cart.Coupon
+		if dest.IsZero() {
+			dest = cart.Destination
+		}
+	} else if coupon != "" {
+		if _, err := srv.coupon(ctx, coupon); err != nil {
+			checkouts.WithLabelValues("failed").Inc()
+			return nil, err
+		}
+	}
+	ctxLogger(ctx).Info("Checkout", zap.String("user_id", b.Sub), pii("name", b.Name), email("email", b.Email), zap.Int("items", len(lines)), zap.String("cart_id", req.GetCartId()))
+	products, err := srv.checkStock(ctx, lines)
 	if err != nil {
-		return wrapperspb.Bool(false), nil
+		if status.Code(err) == codes.FailedPrecondition {
+			checkouts.WithLabelValues("out_of_stock").Inc()
+		} else {
+			checkouts.WithLabelValues("failed").Inc()
+		}
+		return nil, err
 	}
-	if res.Status == "401 Unauthorized" {
-		log.Println("Checkout Unauthorized")
-		return wrapperspb.Bool(false), nil
+	// priced from the store like the carts, the values sent by the client are ignored
+	pls := make([]priceLine, 0, len(lines))
+	for _, c := range lines {
+		pid, _ := primitive.ObjectIDFromHex(c.GetProduct().GetId())
+		p := products[pid]
+		pls = append(pls, priceLine{product: pid, category: p.Category, taxClass: p.TaxClass, qty: c.GetQty(), value: p.Value})
 	}
-	defer res.Body.Close()
-	b := &Body{}
-	if err := json.NewDecoder(res.Body).Decode(&b); err != nil {
-		fmt.Println(err)
-		return nil, status.Errorf(codes.Internal, "Error decoding keycloak response body")
+	if dest.IsZero() {
+		dest = srv.taxDestination
 	}
-	fmt.Println(b)
-	log.Printf("Checkout to: %v - %v\n", b.Name, b.Email)
-
-	log.Printf("Products: %v", req.Cart)
-	return wrapperspb.Bool(true), nil
+	pr, err := srv.price(ctx, pls, coupon, b.Sub, dest)
+	if err != nil {
+		checkouts.WithLabelValues("failed").Inc()
+		return nil, err
+	}
+	release, err := srv.redeemPromotions(ctx, pr, b.Sub)
+	if err != nil {
+		if status.Code(err) == codes.FailedPrecondition {
+			checkouts.WithLabelValues("promotion_exhausted").Inc()
+		} else {
+			checkouts.WithLabelValues("failed").Inc()
+		}
+		return nil, err
+	}
+	o := &MongoOrder{
+		UserID:      b.Sub,
+		Name:        b.Name,
+		Email:       b.Email,
+		Subtotal:    fromCents(pr.subtotal),
+		Discount:    fromCents(pr.discount),
+		Shipping:    fromCents(pr.shipping),
+		Tax:         fromCents(pr.tax.Total),
+		TaxIncluded: pr.tax.Included,
+		Total:       fromCents(pr.total()),
+		Discounts:   orderDiscountsOf(pr.applied),
+		Taxes:       orderTaxesOf(pr.tax.Taxes),
+		Destination: dest,
+		CreatedAt:   time.Now(),
+	}
+	res := &CheckoutResponse{
+		Value:       true,
+		Subtotal:    float32(o.Subtotal),
+		Discount:    float32(o.Discount),
+		Shipping:    float32(o.Shipping),
+		Tax:         float32(o.Tax),
+		Taxes:       taxLinesOf(pr.tax.Taxes),
+		TaxIncluded: o.TaxIncluded,
+		Total:       float32(o.Total),
+		Discounts:   discountsOf(pr.applied),
+	}
+	for i, c := range lines {
+		p := products[pls[i].product]
+		o.Items = append(o.Items, MongoOrderItem{
+			Product:   pls[i].product,
+			Name:      p.Name,
+			Quantity:  c.GetQty(),
+			Value:     p.Value,
+			Discount:  fromCents(pr.lines[i].discount),
+			Discounts: orderDiscountsOf(pr.lines[i].discounts),
+			Tax:       fromCents(pr.tax.Lines[i]),
+		})
+		res.Items = append(res.Items, &CartItem{
+			Product:   dataToProd(*p, requestLocale(ctx)),
+			Qty:       c.GetQty(),
+			Total:     float32(fromCents(pr.lines[i].total)),
+			Available: true,
+			Discounts: discountsOf(pr.lines[i].discounts),
+			Tax:       float32(fromCents(pr.tax.Lines[i])),
+		})
+	}
+	id, err := srv.orders.CreateOrder(ctx, o)
+	if err != nil {
+		release()
+		checkouts.WithLabelValues("failed").Inc()
+		return nil, storeError(ctx, err)
+	}
+	res.OrderId = id.Hex()
+	if cart != nil {
+		if err := srv.carts.DeleteCart(ctx, cart.ID); err != nil {
+			ctxLogger(ctx).Error("Error deleting the checked out cart", zap.Error(err), zap.String("cart_id", cart.ID.Hex()))
+		}
+	}
+	checkouts.WithLabelValues("succeeded").Inc()
+	cartValue.Observe(o.Total)
+	return res, nil
 }
 
-func keycloak(token string) (*http.Response, error) {
-	kcu := os.Getenv("KEYCLOAK_URL")
-	fmt.Println(kcu)
-	data := url.Values{}
-	data.Set("access_token", token)
-	res, err := http.Post(kcu, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
+// checkStock returns FailedPrecondition, with a violation for each product, when the
+// cart has more of a product than the stock or a product that does not exist, and the
+// products otherwise.
+func (srv *server) checkStock(ctx context.Context, cart []*CheckoutRequest_Cart) (map[ObjectID]*MongoProductsData, error) {
+	want := map[ObjectID]int32{}
+	ids := []ObjectID{}
+	for _, c := range cart {
+		pid, err := primitive.ObjectIDFromHex(c.GetProduct().GetId())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Cannot parse ID: %v", c.GetProduct().GetId()))
+		}
+		if _, ok := want[pid]; !ok {
+			ids = append(ids, pid)
+		}
+		want[pid] += c.GetQty()
+	}
+	ps, err := srv.products.ProductsByIDs(ctx, ids)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Keycloak Error: %v", err))
+		return nil, storeError(ctx, err)
+	}
+	stock := map[ObjectID]int32{}
+	byID := map[ObjectID]*MongoProductsData{}
+	for _, p := range ps {
+		stock[p.ID] = p.Quantity
+		byID[p.ID] = p
+	}
+	vs := []*errdetails.PreconditionFailure_Violation{}
+	for _, id := range ids {
+		if want[id] > stock[id] {
+			vs = append(vs, &errdetails.PreconditionFailure_Violation{
+				Type:        "STOCK",
+				Subject:     id.Hex(),
+				Description: fmt.Sprintf("%d requested, %d in stock", want[id], stock[id]),
+			})
+		}
 	}
-	return res, nil
+	if len(vs) == 0 {
+		return byID, nil
+	}
+	st := status.New(codes.FailedPrecondition, "Out of stock")
+	if ds, err := st.WithDetails(&errdetails.PreconditionFailure{Violations: vs}); err == nil {
+		st = ds
+	}
+	return nil, st.Err()
 }
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type fixture struct {
+	store                       *MemoryStore
+	games, rpg, vampire, empty  *MongoCategories
+	vtm, camarilla, chess, dice *MongoProductsData
+}
+
+// newFixture seeds the catalog:
+//
+//	Games (dice)
+//	└── RPG
+//	    └── Vampire (vtm, camarilla)
+//	Empty
+//	Chess (chess)
+func newFixture() *fixture {
+	updated := timestamppb.New(time.Date(2021, 4, 10, 12, 0, 0, 0, time.UTC))
+	f := &fixture{store: NewMemoryStore()}
+	f.games = &MongoCategories{ID: NewObjectID(), Name: "Games", Slug: "games", LastUpdated: updated}
+	f.store.AddCategory(f.games)
+	f.rpg = &MongoCategories{
+		ID:           NewObjectID(),
+		Name:         "RPG",
+		Slug:         "rpg",
+		Ancestors:    []ObjectID{f.games.ID},
+		Translations: []MongoTranslation{{Locale: "pt-BR", Name: "Jogos de Interpretação", Slug: "jogos-de-interpretacao"}},
+		LastUpdated:  updated,
+	}
+	f.store.AddCategory(f.rpg)
+	f.vampire = &MongoCategories{ID: NewObjectID(), Name: "Vampire", Slug: "vampire", Ancestors: []ObjectID{f.games.ID, f.rpg.ID}, LastUpdated: updated}
+	f.store.AddCategory(f.vampire)
+	f.empty = &MongoCategories{ID: NewObjectID(), Name: "Empty", Slug: "empty", LastUpdated: updated}
+	f.store.AddCategory(f.empty)
+	chess := &MongoCategories{ID: NewObjectID(), Name: "Chess", Slug: "chess", LastUpdated: updated}
+	f.store.AddCategory(chess)
+
+	f.vtm = &MongoProductsData{Name: "Vampire: The Masquerade", Slug: "vtm", Quantity: 3, Value: 54.99, Category: f.vampire.ID, LastUpdated: updated}
+	f.camarilla = &MongoProductsData{Name: "Camarilla", Slug: "camarilla", Quantity: 0, Value: 44.99, Category: f.vampire.ID, LastUpdated: updated}
+	f.chess = &MongoProductsData{Name: "Chess Set", Slug: "chess-set", Quantity: 1, Value: 20, Category: chess.ID, LastUpdated: updated}
+	f.dice = &MongoProductsData{
+		Name:         "Dice",
+		Slug:         "dice",
+		Quantity:     100,
+		Value:        1.5,
+		Category:     f.games.ID,
+		Translations: []MongoTranslation{{Locale: "pt-BR", Name: "Dados", Slug: "dados"}},
+		LastUpdated:  updated,
+	}
+	for _, p := range []*MongoProductsData{f.vtm, f.camarilla, f.chess, f.dice} {
+		f.store.AddProduct(p)
+	}
+	return f
+}
+
+// fakeKeycloak answers the userinfo endpoint, accepting only the "valid" token.
+func fakeKeycloak(t *testing.T) *identityClient {
+	kc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("access_token") != "valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(&Body{Sub: "user-1", Name: "Jane Doe", Email: "jane@example.com"})
+	}))
+	t.Cleanup(kc.Close)
+	return newIdentityClient(KeycloakConfig{URL: kc.URL, Timeout: time.Second, CacheTTL: time.Minute})
+}
+
+// newTestClient serves the fixture over an in-memory connection, opts set up the server.
+func newTestClient(t *testing.T, opts ...func(*server)) (*fixture, EcommServiceClient) {
+	setLocales("en", []string{"pt-BR"})
+	f := newFixture()
+	l := bufconn.Listen(1024 * 1024)
+	srv := newServer(f.store)
+	srv.identity = fakeKeycloak(t)
+	for _, o := range opts {
+		o(srv)
+	}
+	s := newGRPCServer(srv)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	cc, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return f, NewEcommServiceClient(cc)
+}
+
+func names(cs []*Category) []string {
+	res := []string{}
+	for _, c := range cs {
+		res = append(res, c.GetName())
+	}
+	return res
+}
+
+func productNames(ps []*Product) []string {
+	res := []string{}
+	for _, p := range ps {
+		res = append(res, p.GetName())
+	}
+	return res
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func assertCode(t *testing.T, err error, c codes.Code) {
+	t.Helper()
+	if status.Code(err) != c {
+		t.Fatalf("expected code %v, got %v", c, err)
+	}
+}
+
+func TestCategoriesMenu(t *testing.T) {
+	f, cl := newTestClient(t)
+	res, err := cl.CategoriesMenu(context.Background(), &CategoriesMenuRequest{IncludeCounts: true})
+	if err != nil {
+		t.Fatalf("CategoriesMenu: %v", err)
+	}
+	if got := names(res.Categories); !equal(got, []string{"Games", "Empty", "Chess"}) {
+		t.Fatalf("unexpected roots: %v", got)
+	}
+	games := res.Categories[0]
+	if got := names(games.Childrens); !equal(got, []string{"RPG"}) {
+		t.Fatalf("unexpected children: %v", got)
+	}
+	if games.Id != f.games.ID.Hex() || games.ProductCount != 3 || games.InStockCount != 2 {
+		t.Fatalf("unexpected games counts: %v", games)
+	}
+	if rpg := games.Childrens[0]; rpg.ProductCount != 2 || rpg.InStockCount != 1 {
+		t.Fatalf("unexpected rpg counts: %v", rpg)
+	}
+	if empty := res.Categories[1]; empty.ProductCount != 0 || len(empty.Childrens) != 0 {
+		t.Fatalf("unexpected empty category: %v", empty)
+	}
+
+	res, err = cl.CategoriesMenu(context.Background(), &CategoriesMenuRequest{})
+	if err != nil {
+		t.Fatalf("CategoriesMenu: %v", err)
+	}
+	if res.Categories[0].ProductCount != 0 {
+		t.Fatalf("counts should not be sent without include_counts: %v", res.Categories[0])
+	}
+}
+
+func TestCategoryBreadcrumb(t *testing.T) {
+	_, cl := newTestClient(t)
+	res, err := cl.CategoryBreadcrumb(context.Background(), &CategoryRequest{Slug: "vampire"})
+	if err != nil {
+		t.Fatalf("CategoryBreadcrumb: %v", err)
+	}
+	if len(res.Categories) != 1 || !equal(names(res.Categories[0].Ancestors), []string{"Games", "RPG"}) {
+		t.Fatalf("unexpected breadcrumb: %v", res)
+	}
+
+	res, err = cl.CategoryBreadcrumb(context.Background(), &CategoryRequest{Slug: "unknown"})
+	if err != nil {
+		t.Fatalf("CategoryBreadcrumb: %v", err)
+	}
+	if len(res.Categories) != 0 {
+		t.Fatalf("expected no categories for an unknown slug: %v", res)
+	}
+}
+
+func TestCategoriesSideMenu(t *testing.T) {
+	_, cl := newTestClient(t)
+	res, err := cl.CategoriesSideMenu(context.Background(), &CategoryRequest{Slug: "rpg", IncludeCounts: true})
+	if err != nil {
+		t.Fatalf("CategoriesSideMenu: %v", err)
+	}
+	if len(res.Categories) != 1 || !equal(names(res.Categories[0].Childrens), []string{"Vampire"}) {
+		t.Fatalf("unexpected side menu: %v", res)
+	}
+	if v := res.Categories[0].Childrens[0]; v.ProductCount != 2 || v.InStockCount != 1 {
+		t.Fatalf("unexpected vampire counts: %v", v)
+	}
+
+	res, err = cl.CategoriesSideMenu(context.Background(), &CategoryRequest{Slug: "empty"})
+	if err != nil {
+		t.Fatalf("CategoriesSideMenu: %v", err)
+	}
+	if len(res.Categories) != 1 || len(res.Categories[0].Childrens) != 0 {
+		t.Fatalf("unexpected side menu for an empty category: %v", res)
+	}
+}
+
+func TestCategoryTree(t *testing.T) {
+	_, cl := newTestClient(t)
+	res, err := cl.CategoryTree(context.Background(), &CategoryTreeRequest{})
+	if err != nil {
+		t.Fatalf("CategoryTree: %v", err)
+	}
+	if got := names(res.Categories); !equal(got, []string{"Games", "Empty", "Chess"}) {
+		t.Fatalf("unexpected roots: %v", got)
+	}
+	rpg := res.Categories[0].Childrens[0]
+	if !equal(names(rpg.Childrens), []string{"Vampire"}) {
+		t.Fatalf("expected the full depth: %v", res.Categories[0])
+	}
+
+	res, err = cl.CategoryTree(context.Background(), &CategoryTreeRequest{Slug: "games", Depth: 1})
+	if err != nil {
+		t.Fatalf("CategoryTree: %v", err)
+	}
+	if len(res.Categories) != 1 || !equal(names(res.Categories[0].Childrens), []string{"RPG"}) || len(res.Categories[0].Childrens[0].Childrens) != 0 {
+		t.Fatalf("expected one level of children: %v", res)
+	}
+	res, err = cl.CategoryTree(context.Background(), &CategoryTreeRequest{Slug: "games", Depth: 2})
+	if err != nil {
+		t.Fatalf("CategoryTree: %v", err)
+	}
+	if vampire := res.Categories[0].Childrens[0].Childrens; !equal(names(vampire), []string{"Vampire"}) || len(vampire[0].Childrens) != 0 {
+		t.Fatalf("expected two levels of children: %v", res)
+	}
+
+	_, err = cl.CategoryTree(context.Background(), &CategoryTreeRequest{Slug: "unknown"})
+	assertCode(t, err, codes.NotFound)
+	_, err = cl.CategoryTree(context.Background(), &CategoryTreeRequest{Depth: -1})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestProducts(t *testing.T) {
+	_, cl := newTestClient(t)
+	res, err := cl.Products(context.Background(), &ProductRequest{Start: 1, Qty: 2})
+	if err != nil {
+		t.Fatalf("Products: %v", err)
+	}
+	if res.Total != 4 || !equal(productNames(res.Data), []string{"Chess Set", "Dice"}) {
+		t.Fatalf("unexpected page: %v", res)
+	}
+	if c := res.Data[0].Category; c.GetName() != "Chess" {
+		t.Fatalf("unexpected product category: %v", c)
+	}
+}
+
+func TestProductsMissingData(t *testing.T) {
+	f, cl := newTestClient(t)
+	f.store.AddProduct(&MongoProductsData{Name: "Orphan", Slug: "orphan", Category: NewObjectID()})
+	res, err := cl.SearchProducts(context.Background(), &SearchProductsRequest{Name: "orphan", Qty: 10})
+	if err != nil {
+		t.Fatalf("SearchProducts: %v", err)
+	}
+	if res.Total != 1 || res.Data[0].Category != nil {
+		t.Fatalf("expected the product without category: %v", res)
+	}
+
+	res, err = cl.Products(context.Background(), &ProductRequest{Start: 100, Qty: 10})
+	if err != nil {
+		t.Fatalf("Products: %v", err)
+	}
+	if res.Total != 5 || len(res.Data) != 0 {
+		t.Fatalf("unexpected page after the end: %v", res)
+	}
+
+	empty := NewMemoryStore()
+	s := newServer(empty)
+	res, err = s.Products(context.Background(), &ProductRequest{Qty: 10})
+	if err != nil {
+		t.Fatalf("Products: %v", err)
+	}
+	if res.Total != 0 || len(res.Data) != 0 {
+		t.Fatalf("expected no products: %v", res)
+	}
+}
+
+func TestRecoveryInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/ecomm.EcommService/Products"}
+	_, err := recoveryInterceptor(context.Background(), nil, info, func(context.Context, interface{}) (interface{}, error) {
+		var d *MongoProducts
+		return d.Metadata[0], nil
+	})
+	assertCode(t, err, codes.Internal)
+}
+
+func TestProductsFromCategory(t *testing.T) {
+	f, cl := newTestClient(t)
+	res, err := cl.ProductsFromCategory(context.Background(), &ProductFromCategoryRequest{CategoryId: f.rpg.ID.Hex(), Qty: 10})
+	if err != nil {
+		t.Fatalf("ProductsFromCategory: %v", err)
+	}
+	if res.Total != 2 || !equal(productNames(res.Data), []string{"Camarilla", "Vampire: The Masquerade"}) {
+		t.Fatalf("expected the products of the subcategories: %v", res)
+	}
+
+	res, err = cl.ProductsFromCategory(context.Background(), &ProductFromCategoryRequest{CategoryId: f.vampire.ID.Hex(), Start: 1, Qty: 10})
+	if err != nil {
+		t.Fatalf("ProductsFromCategory: %v", err)
+	}
+	if res.Total != 2 || !equal(productNames(res.Data), []string{"Vampire: The Masquerade"}) {
+		t.Fatalf("unexpected page: %v", res)
+	}
+
+	res, err = cl.ProductsFromCategory(context.Background(), &ProductFromCategoryRequest{CategoryId: f.empty.ID.Hex(), Qty: 10})
+	if err != nil {
+		t.Fatalf("ProductsFromCategory: %v", err)
+	}
+	if res.Total != 0 || len(res.Data) != 0 {
+		t.Fatalf("expected no products: %v", res)
+	}
+
+	_, err = cl.ProductsFromCategory(context.Background(), &ProductFromCategoryRequest{CategoryId: "invalid", Qty: 10})
+	assertCode(t, err, codes.InvalidArgument)
+	_, err = cl.ProductsFromCategory(context.Background(), &ProductFromCategoryRequest{CategoryId: NewObjectID().Hex(), Qty: 10})
+	assertCode(t, err, codes.NotFound)
+}
+
+func TestSearchProducts(t *testing.T) {
+	_, cl := newTestClient(t)
+	res, err := cl.SearchProducts(context.Background(), &SearchProductsRequest{Name: "VAMP", Qty: 10})
+	if err != nil {
+		t.Fatalf("SearchProducts: %v", err)
+	}
+	if res.Total != 1 || !equal(productNames(res.Data), []string{"Vampire: The Masquerade"}) {
+		t.Fatalf("unexpected search: %v", res)
+	}
+
+	res, err = cl.SearchProducts(context.Background(), &SearchProductsRequest{Name: "dados", Qty: 10})
+	if err != nil {
+		t.Fatalf("SearchProducts: %v", err)
+	}
+	if res.Total != 1 || res.Data[0].GetSlug() != "dice" {
+		t.Fatalf("expected to find the translated name: %v", res)
+	}
+
+	res, err = cl.SearchProducts(context.Background(), &SearchProductsRequest{Name: "nothing", Qty: 10})
+	if err != nil {
+		t.Fatalf("SearchProducts: %v", err)
+	}
+	if res.Total != 0 || len(res.Data) != 0 {
+		t.Fatalf("expected no products: %v", res)
+	}
+}
+
+func TestLocale(t *testing.T) {
+	_, cl := newTestClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "accept-language", "pt-BR,pt;q=0.9,en;q=0.8")
+	var hd metadata.MD
+	res, err := cl.CategoryBreadcrumb(ctx, &CategoryRequest{Slug: "jogos-de-interpretacao"}, grpc.Header(&hd))
+	if err != nil {
+		t.Fatalf("CategoryBreadcrumb: %v", err)
+	}
+	if len(res.Categories) != 1 || res.Categories[0].Name != "Jogos de Interpretação" || res.Categories[0].Ancestors[0].Name != "Games" {
+		t.Fatalf("unexpected translation: %v", res)
+	}
+	if got := hd.Get("content-language"); len(got) != 1 || got[0] != "pt-BR" {
+		t.Fatalf("unexpected content-language: %v", got)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "accept-language", "fr")
+	res, err = cl.CategoryBreadcrumb(ctx, &CategoryRequest{Slug: "jogos-de-interpretacao"})
+	if err != nil {
+		t.Fatalf("CategoryBreadcrumb: %v", err)
+	}
+	if res.Categories[0].Name != "RPG" {
+		t.Fatalf("expected the default locale: %v", res)
+	}
+}
+
+func TestConditionalRead(t *testing.T) {
+	_, cl := newTestClient(t)
+	var hd metadata.MD
+	res, err := cl.CategoriesMenu(context.Background(), &CategoriesMenuRequest{}, grpc.Header(&hd))
+	if err != nil {
+		t.Fatalf("CategoriesMenu: %v", err)
+	}
+	etag := hd.Get("etag")
+	if len(etag) != 1 || len(hd.Get("last-modified")) != 1 || res.NotModified {
+		t.Fatalf("unexpected headers: %v", hd)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "if-none-match", etag[0])
+	res, err = cl.CategoriesMenu(ctx, &CategoriesMenuRequest{})
+	if err != nil {
+		t.Fatalf("CategoriesMenu: %v", err)
+	}
+	if !res.NotModified || len(res.Categories) != 0 {
+		t.Fatalf("expected not modified: %v", res)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "if-modified-since", "Sat, 10 Apr 2021 11:00:00 GMT")
+	res, err = cl.CategoriesMenu(ctx, &CategoriesMenuRequest{})
+	if err != nil {
+		t.Fatalf("CategoriesMenu: %v", err)
+	}
+	if res.NotModified {
+		t.Fatalf("expected the menu to be modified since: %v", res)
+	}
+}
+
+func TestCheckout(t *testing.T) {
+	f, cl := newTestClient(t)
+	req := &CheckoutRequest{Cart: []*CheckoutRequest_Cart{
+		{Product: &Product{Id: f.vtm.ID.Hex(), Name: f.vtm.Name, Value: 54.99}, Qty: 2},
+	}}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "valid")
+	res, err := cl.Checkout(ctx, req)
+	if err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	if !res.GetValue() {
+		t.Fatalf("expected the checkout to succeed")
+	}
+	orders := f.store.Orders()
+	if len(orders) != 1 || orders[0].UserID != "user-1" || orders[0].Items[0].Quantity != 2 {
+		t.Fatalf("unexpected orders: %v", orders)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "expired")
+	res, err = cl.Checkout(ctx, req)
+	if err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	if res.GetValue() {
+		t.Fatalf("expected the checkout to be unauthorized")
+	}
+
+	_, err = cl.Checkout(context.Background(), req)
+	assertCode(t, err, codes.Unauthenticated)
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "valid")
+	_, err = cl.Checkout(ctx, &CheckoutRequest{})
+	assertCode(t, err, codes.InvalidArgument)
+	if len(f.store.Orders()) != 1 {
+		t.Fatalf("unexpected orders: %v", f.store.Orders())
+	}
+}
+
+func TestCheckoutStorePrices(t *testing.T) {
+	f, cl := newTestClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "valid")
+	res, err := cl.Checkout(ctx, &CheckoutRequest{Cart: []*CheckoutRequest_Cart{
+		{Product: &Product{Id: f.vtm.ID.Hex(), Name: "Bargain", Value: 0.01}, Qty: 2},
+	}})
+	if err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	if res.GetSubtotal() != 109.98 || res.GetTotal() != 109.98 || res.GetItems()[0].GetProduct().GetValue() != 54.99 ||
+		res.GetItems()[0].GetProduct().GetName() != f.vtm.Name {
+		t.Fatalf("expected the store prices, got %v", res)
+	}
+	o := f.store.Orders()[0]
+	if o.Total != 109.98 || o.Items[0].Value != 54.99 || o.Items[0].Name != f.vtm.Name {
+		t.Fatalf("unexpected order: %+v", o)
+	}
+}
+
+func TestCheckoutOutOfStock(t *testing.T) {
+	f, cl := newTestClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "valid")
+	_, err := cl.Checkout(ctx, &CheckoutRequest{Cart: []*CheckoutRequest_Cart{
+		{Product: &Product{Id: f.vtm.ID.Hex()}, Qty: 2},
+		{Product: &Product{Id: f.vtm.ID.Hex()}, Qty: 2},
+		{Product: &Product{Id: f.camarilla.ID.Hex()}, Qty: 1},
+		{Product: &Product{Id: f.chess.ID.Hex()}, Qty: 1},
+	}})
+	assertCode(t, err, codes.FailedPrecondition)
+	subjects := []string{}
+	for _, d := range status.Convert(err).Details() {
+		if pf, ok := d.(*errdetails.PreconditionFailure); ok {
+			for _, v := range pf.Violations {
+				subjects = append(subjects, v.Subject)
+			}
+		}
+	}
+	if !equal(subjects, []string{f.vtm.ID.Hex(), f.camarilla.ID.Hex()}) {
+		t.Fatalf("unexpected violations: %v", subjects)
+	}
+	if len(f.store.Orders()) != 0 {
+		t.Fatalf("unexpected orders: %v", f.store.Orders())
+	}
+}
+
+func TestDeadlineInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/ecomm.EcommService/Products"}
+	_, err := deadlineInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Fatalf("expected the default deadline")
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("deadlineInterceptor: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	store := NewMemoryStore()
+	_, err = newServer(store).Products(ctx, &ProductRequest{Qty: 10})
+	assertCode(t, err, codes.DeadlineExceeded)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = newServer(store).CategoriesMenu(ctx, &CategoriesMenuRequest{})
+	assertCode(t, err, codes.Canceled)
+}
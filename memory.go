@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore implements the repositories in memory, with the same results as MongoStore.
+// It is used by the tests and by the demo mode.
+type MemoryStore struct {
+	sync.RWMutex
+	categories []*MongoCategories
+	products   []*MongoProductsData
+	orders     []*MongoOrder
+	carts      []*MongoCart
+	promotions []*MongoPromotion
+	// redemptions are the uses of the promotions by user.
+	redemptions map[ObjectID]map[string]int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// AddCategory stores the category, adding it to the childrens of its parent,
+// the last of the ancestors.
+func (m *MemoryStore) AddCategory(c *MongoCategories) {
+	m.Lock()
+	defer m.Unlock()
+	if c.ID.IsZero() {
+		c.ID = NewObjectID()
+	}
+	if len(c.Ancestors) > 0 {
+		p := m.category(c.Ancestors[len(c.Ancestors)-1])
+		if p != nil && !containsID(p.Childrens, c.ID) {
+			p.Childrens = append(p.Childrens, c.ID)
+		}
+	}
+	m.categories = append(m.categories, c)
+}
+
+func (m *MemoryStore) AddProduct(p *MongoProductsData) {
+	m.Lock()
+	defer m.Unlock()
+	if p.ID.IsZero() {
+		p.ID = NewObjectID()
+	}
+	m.products = append(m.products, p)
+}
+
+// AddPromotion stores the promotion, with its code upper case like MongoStore expects it.
+func (m *MemoryStore) AddPromotion(p *MongoPromotion) {
+	m.Lock()
+	defer m.Unlock()
+	if p.ID.IsZero() {
+		p.ID = NewObjectID()
+	}
+	p.Code = strings.ToUpper(p.Code)
+	m.promotions = append(m.promotions, p)
+}
+
+func (m *MemoryStore) Orders() []*MongoOrder {
+	m.RLock()
+	defer m.RUnlock()
+	return append([]*MongoOrder{}, m.orders...)
+}
+
+func containsID(ids []ObjectID, id ObjectID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStore) category(id ObjectID) *MongoCategories {
+	for _, c := range m.categories {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// lookup returns copies of the listed categories, like $graphLookup with maxDepth 0.
+func (m *MemoryStore) lookup(ids []ObjectID) []*MongoCategories {
+	res := []*MongoCategories{}
+	for _, id := range ids {
+		if c := m.category(id); c != nil {
+			cc := *c
+			res = append(res, &cc)
+		}
+	}
+	return res
+}
+
+// descendants follows the childrens at any depth, like $graphLookup without maxDepth.
+func (m *MemoryStore) descendants(c *MongoCategories) []*MongoCategories {
+	res := []*MongoCategories{}
+	seen := map[ObjectID]bool{c.ID: true}
+	next := c.Childrens
+	for len(next) > 0 {
+		ids := []ObjectID{}
+		for _, sc := range m.lookup(next) {
+			if seen[sc.ID] {
+				continue
+			}
+			seen[sc.ID] = true
+			res = append(res, sc)
+			ids = append(ids, sc.Childrens...)
+		}
+		next = ids
+	}
+	return res
+}
+
+func (m *MemoryStore) RootCategories(ctx context.Context) ([]*MongoCategories, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.RLock()
+	defer m.RUnlock()
+	ds := []*MongoCategories{}
+	for _, c := range m.categories {
+		if len(c.Ancestors) == 0 {
+			d := *c
+			d.Subcategories = m.lookup(c.Childrens)
+			ds = append(ds, &d)
+		}
+	}
+	return ds, nil
+}
+
+func (m *MemoryStore) CategoriesBySlug(ctx context.Context, slug string) ([]*MongoCategories, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.RLock()
+	defer m.RUnlock()
+	ds := []*MongoCategories{}
+	for _, c := range m.categories {
+		if c.Slug == slug || hasTranslatedSlug(c.Translations, slug) {
+			d := *c
+			d.Parents = m.lookup(c.Ancestors)
+			d.Subcategories = m.lookup(c.Childrens)
+			ds = append(ds, &d)
+		}
+	}
+	return ds, nil
+}
+
+func (m *MemoryStore) AllCategories(ctx context.Context) ([]*MongoCategories, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.RLock()
+	defer m.RUnlock()
+	ds := []*MongoCategories{}
+	for _, c := range m.categories {
+		d := *c
+		ds = append(ds, &d)
+	}
+	return ds, nil
+}
+
+func (m *MemoryStore) CategoriesWithDescendants(ctx context.Context) ([]*MongoCategories, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.RLock()
+	defer m.RUnlock()
+	ds := []*MongoCategories{}
+	for _, c := range m.categories {
+		d := *c
+		d.Subcategories = m.descendants(c)
+		ds = append(ds, &d)
+	}
+	return ds, nil
+}
+
+func (m *MemoryStore) Descendants(ctx context.Context, id ObjectID) ([]ObjectID, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.RLock()
+	defer m.RUnlock()
+	c := m.category(id)
+	if c == nil {
+		return nil, ErrCategoryNotFound
+	}
+	cats := []ObjectID{}
+	for _, sc := range m.descendants(c) {
+		cats = append(cats, sc.ID)
+	}
+	return cats, nil
+}
+
+func (m *MemoryStore) ListProducts(ctx context.Context, f ProductFilter, start, qty int32) (*MongoProducts, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if start < 0 {
+		return nil, errors.New("$skip requires a non-negative number")
+	}
+	if qty <= 0 {
+		return nil, errors.New("the limit must be positive")
+	}
+	var re *regexp.Regexp
+	if f.Name != "" {
+		var err error
+		if re, err = regexp.Compile("(?i)" + f.Name); err != nil {
+			return nil, err
+		}
+	}
+	m.RLock()
+	defer m.RUnlock()
+	ps := []MongoProductsData{}
+	for _, p := range m.products {
+		if len(f.Categories) > 0 && !containsID(f.Categories, p.Category) {
+			continue
+		}
+		if re != nil && !re.MatchString(p.Name) && !translatedNameMatches(p.Translations, re) {
+			continue
+		}
+		d := *p
+		d.Cat = []MongoCategories{}
+		for _, c := range m.lookup([]ObjectID{p.Category}) {
+			d.Cat = append(d.Cat, *c)
+		}
+		ps = append(ps, d)
+	}
+	sort.SliceStable(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
+	d := &MongoProducts{}
+	if len(ps) == 0 {
+		return d, nil
+	}
+	d.Metadata = []MongoProductsMetadata{{Total: int32(len(ps))}}
+	if int(start) < len(ps) {
+		ps = ps[start:]
+		if int(qty) < len(ps) {
+			ps = ps[:qty]
+		}
+		d.Data = ps
+	}
+	return d, nil
+}
+
+func translatedNameMatches(ts []MongoTranslation, re *regexp.Regexp) bool {
+	for _, t := range ts {
+		if re.MatchString(t.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStore) CountProducts(ctx context.Context) (map[ObjectID]CategoryCount, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.RLock()
+	defer m.RUnlock()
+	counts := map[ObjectID]CategoryCount{}
+	for _, p := range m.products {
+		c := counts[p.Category]
+		c.Total++
+		if p.Quantity > 0 {
+			c.InStock++
+		}
+		counts[p.Category] = c
+	}
+	return counts, nil
+}
+
+func (m *MemoryStore) ProductsByIDs(ctx context.Context, ids []ObjectID) ([]*MongoProductsData, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.RLock()
+	defer m.RUnlock()
+	ps := []*MongoProductsData{}
+	for _, p := range m.products {
+		if containsID(ids, p.ID) {
+			d := *p
+			ps = append(ps, &d)
+		}
+	}
+	return ps, nil
+}
+
+func (m *MemoryStore) CreateOrder(ctx context.Context, o *MongoOrder) (ObjectID, error) {
+	if ctx.Err() != nil {
+		return NilObjectID, ctx.Err()
+	}
+	m.Lock()
+	defer m.Unlock()
+	if o.ID.IsZero() {
+		o.ID = NewObjectID()
+	}
+	if o.CreatedAt.IsZero() {
+		o.CreatedAt = time.Now()
+	}
+	m.orders = append(m.orders, o)
+	return o.ID, nil
+}
+
+// cart returns a copy of the first cart matching, like FindOne.
+func (m *MemoryStore) cart(ctx context.Context, match func(c *MongoCart) bool) (*MongoCart, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.RLock()
+	defer m.RUnlock()
+	for _, c := range m.carts {
+		if match(c) {
+			d := *c
+			d.Items = append([]MongoCartItem{}, c.Items...)
+			d.Merged = append([]ObjectID{}, c.Merged...)
+			return &d, nil
+		}
+	}
+	return nil, ErrCartNotFound
+}
+
+func (m *MemoryStore) CartByID(ctx context.Context, id ObjectID) (*MongoCart, error) {
+	return m.cart(ctx, func(c *MongoCart) bool { return c.ID == id })
+}
+
+func (m *MemoryStore) CartByUser(ctx context.Context, userID string) (*MongoCart, error) {
+	return m.cart(ctx, func(c *MongoCart) bool { return c.UserID != "" && c.UserID == userID })
+}
+
+func (m *MemoryStore) CartByToken(ctx context.Context, tokenHash string) (*MongoCart, error) {
+	return m.cart(ctx, func(c *MongoCart) bool { return c.TokenHash != "" && c.TokenHash == tokenHash })
+}
+
+func (m *MemoryStore) SaveCart(ctx context.Context, c *MongoCart) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	m.Lock()
+	defer m.Unlock()
+	n := *c
+	n.Items = append([]MongoCartItem{}, c.Items...)
+	n.Merged = append([]ObjectID{}, c.Merged...)
+	n.Version++
+	n.UpdatedAt = time.Now()
+	i := -1
+	for j, o := range m.carts {
+		switch {
+		case o.ID == c.ID:
+			if o.Version != c.Version {
+				return ErrCartConflict
+			}
+			i = j
+		case c.UserID != "" && o.UserID == c.UserID, c.TokenHash != "" && o.TokenHash == c.TokenHash:
+			// the unique indexes
+			return ErrCartConflict
+		}
+	}
+	if c.ID.IsZero() {
+		n.ID = NewObjectID()
+		m.carts = append(m.carts, &n)
+	} else if i < 0 {
+		return ErrCartConflict
+	} else {
+		m.carts[i] = &n
+	}
+	*c = n
+	c.Items = append([]MongoCartItem{}, n.Items...)
+	return nil
+}
+
+func (m *MemoryStore) DeleteCart(ctx context.Context, id ObjectID) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	m.Lock()
+	defer m.Unlock()
+	for i, c := range m.carts {
+		if c.ID == id {
+			m.carts = append(m.carts[:i], m.carts[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) ActivePromotions(ctx context.Context, at time.Time) ([]*MongoPromotion, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.RLock()
+	defer m.RUnlock()
+	ps := []*MongoPromotion{}
+	for _, p := range m.promotions {
+		if p.Code == "" && p.active(at) {
+			c := *p
+			ps = append(ps, &c)
+		}
+	}
+	return ps, nil
+}
+
+func (m *MemoryStore) PromotionByCode(ctx context.Context, code string) (*MongoPromotion, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.RLock()
+	defer m.RUnlock()
+	for _, p := range m.promotions {
+		if p.Code != "" && p.Code == strings.ToUpper(code) {
+			c := *p
+			return &c, nil
+		}
+	}
+	return nil, ErrPromotionNotFound
+}
+
+func (m *MemoryStore) Redemptions(ctx context.Context, userID string, ids []ObjectID) (map[ObjectID]int64, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	m.RLock()
+	defer m.RUnlock()
+	res := map[ObjectID]int64{}
+	for _, id := range ids {
+		if n := m.redemptions[id][userID]; n > 0 {
+			res[id] = n
+		}
+	}
+	return res, nil
+}
+
+func (m *MemoryStore) promotion(id ObjectID) *MongoPromotion {
+	for _, p := range m.promotions {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) RedeemPromotion(ctx context.Context, p *MongoPromotion, userID string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	m.Lock()
+	defer m.Unlock()
+	sp := m.promotion(p.ID)
+	if sp == nil || (p.MaxUses > 0 && sp.Uses >= p.MaxUses) {
+		return ErrPromotionExhausted
+	}
+	if userID != "" {
+		if p.MaxUsesPerCustomer > 0 && m.redemptions[p.ID][userID] >= p.MaxUsesPerCustomer {
+			return ErrPromotionExhausted
+		}
+		if m.redemptions == nil {
+			m.redemptions = map[ObjectID]map[string]int64{}
+		}
+		if m.redemptions[p.ID] == nil {
+			m.redemptions[p.ID] = map[string]int64{}
+		}
+		m.redemptions[p.ID][userID]++
+	}
+	sp.Uses++
+	return nil
+}
+
+func (m *MemoryStore) ReleasePromotion(ctx context.Context, p *MongoPromotion, userID string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	m.Lock()
+	defer m.Unlock()
+	if sp := m.promotion(p.ID); sp != nil {
+		sp.Uses--
+	}
+	if userID != "" && m.redemptions[p.ID] != nil {
+		m.redemptions[p.ID][userID]--
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ecomm_grpc_requests_total",
+		Help: "gRPC calls by method and status code.",
+	}, []string{"method", "code"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ecomm_grpc_request_duration_seconds",
+		Help:    "Duration of the gRPC calls by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ecomm_mongo_query_duration_seconds",
+		Help:    "Duration of the MongoDB queries by pipeline.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"pipeline"})
+	queryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ecomm_mongo_query_errors_total",
+		Help: "Failed MongoDB queries by pipeline.",
+	}, []string{"pipeline"})
+	checkoutAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ecomm_checkout_attempts_total",
+		Help: "Checkout calls.",
+	})
+	checkouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ecomm_checkouts_total",
+		Help: "Checkouts by result: succeeded, unauthorized, out_of_stock, promotion_exhausted or failed.",
+	}, []string{"result"})
+	cartValue = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ecomm_checkout_cart_value",
+		Help:    "Total value of the carts of the succeeded checkouts.",
+		Buckets: []float64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(rpcRequests, rpcDuration, queryDuration, queryErrors, checkoutAttempts, checkouts, cartValue)
+}
+
+// metricsInterceptor counts the calls by method and code and observes their duration.
+func metricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	res, err := handler(ctx, req)
+	observeRPC(info.FullMethod, start, err)
+	return res, err
+}
+
+func streamMetricsInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeRPC(info.FullMethod, start, err)
+	return err
+}
+
+func observeRPC(method string, start time.Time, err error) {
+	rpcRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// observeQuery records the duration, and the error, of a MongoDB query.
+func observeQuery(pipeline string, start time.Time, err *error) {
+	queryDuration.WithLabelValues(pipeline).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		queryErrors.WithLabelValues(pipeline).Inc()
+	}
+}
+
+// cacheCollector exposes the hits and misses of the catalog cache.
+type cacheCollector struct {
+	cache  *catalogCache
+	hits   *prometheus.Desc
+	misses *prometheus.Desc
+}
+
+func newCacheCollector(c *catalogCache) *cacheCollector {
+	return &cacheCollector{
+		cache:  c,
+		hits:   prometheus.NewDesc("ecomm_cache_hits_total", "Catalog cache hits by kind.", []string{"kind"}, nil),
+		misses: prometheus.NewDesc("ecomm_cache_misses_total", "Catalog cache misses by kind.", []string{"kind"}, nil),
+	}
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	for kind, s := range c.cache.Stats() {
+		ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(s.Hits), kind)
+		ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(s.Misses), kind)
+	}
+}
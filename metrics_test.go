@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestMetrics(t *testing.T) {
+	f, cl := newTestClient(t)
+	method := "/ecomm.EcommService/Products"
+	ok := testutil.ToFloat64(rpcRequests.WithLabelValues(method, "OK"))
+	invalid := testutil.ToFloat64(rpcRequests.WithLabelValues(method, "InvalidArgument"))
+	cl.Products(context.Background(), &ProductRequest{Qty: 1})
+	cl.Products(context.Background(), &ProductRequest{Qty: 0})
+	if got := testutil.ToFloat64(rpcRequests.WithLabelValues(method, "OK")) - ok; got != 1 {
+		t.Errorf("OK calls: got %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(rpcRequests.WithLabelValues(method, "InvalidArgument")) - invalid; got != 1 {
+		t.Errorf("InvalidArgument calls: got %v, want 1", got)
+	}
+
+	attempts := testutil.ToFloat64(checkoutAttempts)
+	succeeded := testutil.ToFloat64(checkouts.WithLabelValues("succeeded"))
+	unauthorized := testutil.ToFloat64(checkouts.WithLabelValues("unauthorized"))
+	outOfStock := testutil.ToFloat64(checkouts.WithLabelValues("out_of_stock"))
+	checkout := func(token string, qty int32) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", token)
+		cl.Checkout(ctx, &CheckoutRequest{Cart: []*CheckoutRequest_Cart{
+			{Product: &Product{Id: f.vtm.ID.Hex(), Name: f.vtm.Name, Value: 54.99}, Qty: qty},
+		}})
+	}
+	checkout("valid", 1)
+	checkout("expired", 1)
+	checkout("valid", 4)
+	for name, got := range map[string]float64{
+		"attempts":     testutil.ToFloat64(checkoutAttempts) - attempts,
+		"succeeded":    testutil.ToFloat64(checkouts.WithLabelValues("succeeded")) - succeeded,
+		"unauthorized": testutil.ToFloat64(checkouts.WithLabelValues("unauthorized")) - unauthorized,
+		"out_of_stock": testutil.ToFloat64(checkouts.WithLabelValues("out_of_stock")) - outOfStock,
+	} {
+		want := 1.0
+		if name == "attempts" {
+			want = 3
+		}
+		if got != want {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestObserveQuery(t *testing.T) {
+	errs := testutil.ToFloat64(queryErrors.WithLabelValues("test"))
+	var err error
+	observeQuery("test", time.Now(), &err)
+	err = errors.New("boom")
+	observeQuery("test", time.Now(), &err)
+	if got := testutil.ToFloat64(queryErrors.WithLabelValues("test")) - errs; got != 1 {
+		t.Errorf("query errors: got %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(queryDuration); got == 0 {
+		t.Error("expected query durations")
+	}
+}
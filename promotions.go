@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// priceLine is a line to price, with the unit value, the category and the tax class of its product.
+type priceLine struct {
+	product  ObjectID
+	category ObjectID
+	taxClass string
+	qty      int32
+	value    float64
+}
+
+// promotion is an active promotion with its categories expanded to their subcategories.
+type promotion struct {
+	*MongoPromotion
+	categories map[ObjectID]bool
+}
+
+// covers tells if the promotion applies to the line.
+func (p *promotion) covers(l priceLine) bool {
+	if len(p.Products) == 0 && len(p.Categories) == 0 {
+		return true
+	}
+	return containsID(p.Products, l.product) || p.categories[l.category]
+}
+
+type lineDiscount struct {
+	promotion *MongoPromotion
+	amount    int64
+}
+
+// pricedLine and priced are the results of applyPromotions and of the taxes, in cents.
+type pricedLine struct {
+	total     int64
+	discount  int64
+	discounts []lineDiscount
+}
+
+type priced struct {
+	lines    []pricedLine
+	subtotal int64
+	discount int64
+	shipping int64
+	// shippingDiscount is the part of the discount on the shipping.
+	shippingDiscount int64
+	// applied has the total of each promotion with a discount, in the order applied.
+	applied []lineDiscount
+	tax     *TaxResult
+}
+
+func (p *priced) total() int64 {
+	t := p.subtotal - p.discount + p.shipping
+	if p.tax != nil && !p.tax.Included {
+		t += p.tax.Total
+	}
+	return t
+}
+
+func cents(v float64) int64 {
+	return int64(math.Round(v * 100))
+}
+
+func fromCents(c int64) float64 {
+	return float64(c) / 100
+}
+
+// sortPromotions orders the promotions by priority, the highest first, then by id, so
+// the same cart always gets the same discounts.
+func sortPromotions(ps []*promotion) {
+	sort.SliceStable(ps, func(i, j int) bool {
+		if ps[i].Priority != ps[j].Priority {
+			return ps[i].Priority > ps[j].Priority
+		}
+		return bytes.Compare(ps[i].ID[:], ps[j].ID[:]) < 0
+	})
+}
+
+// applyPromotions prices the lines with the shipping, applying the promotions one
+// after the other on what the previous ones left of each line and of the shipping.
+func applyPromotions(lines []priceLine, ps []*promotion, shipping int64) *priced {
+	res := &priced{lines: make([]pricedLine, len(lines))}
+	for i, l := range lines {
+		res.lines[i].total = cents(l.value * float64(l.qty))
+		res.subtotal += res.lines[i].total
+	}
+	if len(lines) > 0 {
+		res.shipping = shipping
+	}
+	shippingLeft := res.shipping
+	for _, p := range ps {
+		if res.subtotal < cents(p.MinCartValue) {
+			continue
+		}
+		amounts := make([]int64, len(lines))
+		covered := []int{}
+		for i, l := range lines {
+			if p.covers(l) {
+				covered = append(covered, i)
+			}
+		}
+		if len(covered) == 0 {
+			continue
+		}
+		left := func(i int) int64 { return res.lines[i].total - res.lines[i].discount }
+		onShipping := int64(0)
+		switch p.Type {
+		case PromotionPercentage:
+			pct := math.Max(0, math.Min(p.Value, 100))
+			for _, i := range covered {
+				amounts[i] = int64(math.Round(float64(left(i)) * pct / 100))
+			}
+		case PromotionFixed:
+			base := int64(0)
+			for _, i := range covered {
+				base += left(i)
+			}
+			amount := cents(p.Value)
+			if amount > base {
+				amount = base
+			}
+			if amount <= 0 {
+				continue
+			}
+			// split in proportion to the lines, the cents left one by one from the first line
+			given := int64(0)
+			for _, i := range covered {
+				amounts[i] = amount * left(i) / base
+				given += amounts[i]
+			}
+			for _, i := range covered {
+				if given == amount {
+					break
+				}
+				if amounts[i] < left(i) {
+					amounts[i]++
+					given++
+				}
+			}
+		case PromotionBuyXGetY:
+			if p.BuyQty < 1 || p.GetQty < 1 {
+				continue
+			}
+			for _, i := range covered {
+				free := lines[i].qty / (p.BuyQty + p.GetQty) * p.GetQty
+				amounts[i] = cents(lines[i].value) * int64(free)
+				if amounts[i] > left(i) {
+					amounts[i] = left(i)
+				}
+			}
+		case PromotionFreeShipping:
+			onShipping = shippingLeft
+		}
+		total := onShipping
+		for i, a := range amounts {
+			if a > 0 {
+				total += a
+				res.lines[i].discount += a
+				res.lines[i].discounts = append(res.lines[i].discounts, lineDiscount{p.MongoPromotion, a})
+			}
+		}
+		if total == 0 {
+			continue
+		}
+		shippingLeft -= onShipping
+		res.shippingDiscount += onShipping
+		res.discount += total
+		res.applied = append(res.applied, lineDiscount{p.MongoPromotion, total})
+	}
+	return res
+}
+
+// promotionsFor returns the active promotions, with the one of the coupon, less the
+// ones the user used as many times as allowed, in the order they apply.
+func (srv *server) promotionsFor(ctx context.Context, coupon, userID string, at time.Time) ([]*promotion, error) {
+	ms, err := srv.promotions.ActivePromotions(ctx, at)
+	if err != nil {
+		return nil, err
+	}
+	if coupon != "" {
+		p, err := srv.promotions.PromotionByCode(ctx, coupon)
+		switch {
+		case err == ErrPromotionNotFound:
+			// a coupon deleted after it was applied
+		case err != nil:
+			return nil, err
+		case p.active(at):
+			ms = append(ms, p)
+		}
+	}
+	if userID != "" && len(ms) > 0 {
+		ids := make([]ObjectID, 0, len(ms))
+		for _, p := range ms {
+			ids = append(ids, p.ID)
+		}
+		used, err := srv.promotions.Redemptions(ctx, userID, ids)
+		if err != nil {
+			return nil, err
+		}
+		limited := ms[:0]
+		for _, p := range ms {
+			if p.MaxUsesPerCustomer == 0 || used[p.ID] < p.MaxUsesPerCustomer {
+				limited = append(limited, p)
+			}
+		}
+		ms = limited
+	}
+	ps := make([]*promotion, 0, len(ms))
+	for _, p := range ms {
+		cats := map[ObjectID]bool{}
+		for _, id := range p.Categories {
+			cats[id] = true
+			// cached like the listings of the categories
+			ds, err := srv.seeProductCategories(ctx, id)
+			if err == ErrCategoryNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range ds {
+				cats[d] = true
+			}
+		}
+		ps = append(ps, &promotion{MongoPromotion: p, categories: cats})
+	}
+	sortPromotions(ps)
+	return ps, nil
+}
+
+// price applies the promotions of the moment to the lines, then the taxes of the
+// destination, the default one when it is empty.
+func (srv *server) price(ctx context.Context, lines []priceLine, coupon, userID string, dest TaxDestination) (*priced, error) {
+	ps, err := srv.promotionsFor(ctx, coupon, userID, time.Now())
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	res := applyPromotions(lines, ps, cents(srv.shippingFee))
+	if dest.IsZero() {
+		dest = srv.taxDestination
+	}
+	tls := make([]TaxableLine, len(lines))
+	for i, l := range lines {
+		tls[i] = TaxableLine{TaxClass: l.taxClass, Amount: res.lines[i].total - res.lines[i].discount}
+	}
+	if res.tax, err = srv.taxes.Calculate(ctx, dest, tls, res.shipping-res.shippingDiscount); err != nil {
+		ctxLogger(ctx).Error("Error calculating the taxes", zap.Error(err), zap.String("country", dest.Country))
+		return nil, status.Errorf(codes.Unavailable, "Tax calculation unavailable, retry later")
+	}
+	return res, nil
+}
+
+// coupon returns the promotion of the coupon code, NotFound when there is none and
+// FailedPrecondition when it is not valid now.
+func (srv *server) coupon(ctx context.Context, code string) (*MongoPromotion, error) {
+	p, err := srv.promotions.PromotionByCode(ctx, code)
+	if err == ErrPromotionNotFound {
+		return nil, status.Errorf(codes.NotFound, "Coupon not found: %v", code)
+	}
+	if err != nil {
+		return nil, storeError(ctx, err)
+	}
+	if !p.active(time.Now()) {
+		return nil, status.Errorf(codes.FailedPrecondition, "The coupon is not valid: %v", code)
+	}
+	return p, nil
+}
+
+// redeemPromotions counts the uses of the applied promotions, returning FailedPrecondition
+// with the promotion when one was used up in the meantime, and release to give them
+// back when the order is not created.
+func (srv *server) redeemPromotions(ctx context.Context, p *priced, userID string) (release func(), err error) {
+	done := []*MongoPromotion{}
+	release = func() {
+		for _, d := range done {
+			if err := srv.promotions.ReleasePromotion(ctx, d, userID); err != nil {
+				ctxLogger(ctx).Error("Error releasing the promotion", zap.Error(err), zap.String("promotion_id", d.ID.Hex()))
+			}
+		}
+	}
+	for _, a := range p.applied {
+		err := srv.promotions.RedeemPromotion(ctx, a.promotion, userID)
+		if err == ErrPromotionExhausted {
+			release()
+			st := status.New(codes.FailedPrecondition, "Promotion no longer available")
+			if ds, err := st.WithDetails(&errdetails.PreconditionFailure{Violations: []*errdetails.PreconditionFailure_Violation{{
+				Type:        "PROMOTION",
+				Subject:     a.promotion.ID.Hex(),
+				Description: fmt.Sprintf("%v reached its usage limit", a.promotion.Name),
+			}}}); err == nil {
+				st = ds
+			}
+			return nil, st.Err()
+		}
+		if err != nil {
+			release()
+			return nil, storeError(ctx, err)
+		}
+		done = append(done, a.promotion)
+	}
+	return release, nil
+}
+
+func discountsOf(ds []lineDiscount) []*Discount {
+	res := []*Discount{}
+	for _, d := range ds {
+		res = append(res, &Discount{
+			PromotionId: d.promotion.ID.Hex(),
+			Name:        d.promotion.Name,
+			Code:        d.promotion.Code,
+			Amount:      float32(fromCents(d.amount)),
+		})
+	}
+	return res
+}
+
+func orderDiscountsOf(ds []lineDiscount) []MongoOrderDiscount {
+	var res []MongoOrderDiscount
+	for _, d := range ds {
+		res = append(res, MongoOrderDiscount{
+			Promotion: d.promotion.ID,
+			Name:      d.promotion.Name,
+			Code:      d.promotion.Code,
+			Amount:    fromCents(d.amount),
+		})
+	}
+	return res
+}
+
+func (srv *server) ApplyCoupon(ctx context.Context, req *CouponRequest) (*Cart, error) {
+	ctxLogger(ctx).Debug("ApplyCoupon called", zap.String("code", req.GetCode()))
+	p, err := srv.coupon(ctx, req.GetCode())
+	if err != nil {
+		return nil, err
+	}
+	return srv.changeCart(ctx, true, func(c *MongoCart) error {
+		c.Coupon = p.Code
+		return nil
+	})
+}
+
+func (srv *server) RemoveCoupon(ctx context.Context, req *RemoveCouponRequest) (*Cart, error) {
+	ctxLogger(ctx).Debug("RemoveCoupon called")
+	return srv.changeCart(ctx, false, func(c *MongoCart) error {
+		c.Coupon = ""
+		return nil
+	})
+}
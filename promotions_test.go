@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestApplyPromotions(t *testing.T) {
+	x, y := NewObjectID(), NewObjectID()
+	a := priceLine{product: NewObjectID(), category: x, qty: 3, value: 10}
+	b := priceLine{product: NewObjectID(), category: y, qty: 1, value: 5}
+	promo := func(p MongoPromotion) *promotion {
+		p.ID = NewObjectID()
+		cats := map[ObjectID]bool{}
+		for _, c := range p.Categories {
+			cats[c] = true
+		}
+		return &promotion{MongoPromotion: &p, categories: cats}
+	}
+	half := promo(MongoPromotion{Type: PromotionPercentage, Value: 50, Priority: 1})
+	hundred := promo(MongoPromotion{Type: PromotionFixed, Value: 100})
+	for _, tt := range []struct {
+		name     string
+		ps       []*promotion
+		lines    []int64
+		shipping int64
+		total    int64
+	}{
+		{"none", nil, []int64{0, 0}, 0, 4000},
+		{"percentage", []*promotion{promo(MongoPromotion{Type: PromotionPercentage, Value: 10})}, []int64{300, 50}, 0, 3650},
+		{"fixed on a category", []*promotion{promo(MongoPromotion{Type: PromotionFixed, Value: 10, Categories: []ObjectID{x}})}, []int64{1000, 0}, 0, 3000},
+		{"fixed split between the lines", []*promotion{promo(MongoPromotion{Type: PromotionFixed, Value: 1})}, []int64{86, 14}, 0, 3900},
+		{"buy 2 get 1", []*promotion{promo(MongoPromotion{Type: PromotionBuyXGetY, BuyQty: 2, GetQty: 1, Products: []ObjectID{a.product, b.product}})}, []int64{1000, 0}, 0, 3000},
+		{"free shipping", []*promotion{promo(MongoPromotion{Type: PromotionFreeShipping, MinCartValue: 30})}, []int64{0, 0}, 500, 3500},
+		{"below the minimum", []*promotion{promo(MongoPromotion{Type: PromotionFreeShipping, MinCartValue: 40})}, []int64{0, 0}, 0, 4000},
+		{"out of scope", []*promotion{promo(MongoPromotion{Type: PromotionPercentage, Value: 10, Products: []ObjectID{NewObjectID()}})}, []int64{0, 0}, 0, 4000},
+		{"stacked by priority", []*promotion{hundred, half}, []int64{3000, 500}, 0, 500},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sortPromotions(tt.ps)
+			res := applyPromotions([]priceLine{a, b}, tt.ps, 500)
+			got := []int64{}
+			lines := int64(0)
+			for _, l := range res.lines {
+				got = append(got, l.discount)
+				lines += l.discount
+			}
+			if len(got) != len(tt.lines) || got[0] != tt.lines[0] || got[1] != tt.lines[1] {
+				t.Errorf("got line discounts %v, want %v", got, tt.lines)
+			}
+			if res.discount-lines != tt.shipping || res.total() != tt.total {
+				t.Errorf("got shipping discount %v and total %v, want %v and %v", res.discount-lines, res.total(), tt.shipping, tt.total)
+			}
+		})
+	}
+}
+
+func TestCartPromotions(t *testing.T) {
+	f, cl := newTestClient(t, func(s *server) { s.shippingFee = 9.9 })
+	free := &MongoPromotion{Name: "Free shipping", Type: PromotionFreeShipping, MinCartValue: 100}
+	f.store.AddPromotion(free)
+	rpg := &MongoPromotion{Name: "10% off RPG", Code: "rpg10", Type: PromotionPercentage, Value: 10, Categories: []ObjectID{f.rpg.ID}}
+	f.store.AddPromotion(rpg)
+	f.store.AddPromotion(&MongoPromotion{Name: "Old", Code: "old", Type: PromotionFixed, Value: 5, EndsAt: time.Now().Add(-time.Hour)})
+
+	ctx := context.Background()
+	c, err := cl.AddCartItem(ctx, &CartItemRequest{ProductId: f.dice.ID.Hex(), Qty: 10})
+	if err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	if c.GetShipping() != 9.9 || c.GetDiscount() != 0 || c.GetTotal() != 24.9 {
+		t.Fatalf("expected the shipping without discounts, got %v", c)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, cartTokenHeader, c.GetToken())
+	if _, err = cl.AddCartItem(ctx, &CartItemRequest{ProductId: f.vtm.ID.Hex(), Qty: 2}); err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	if c, err = cl.ApplyCoupon(ctx, &CouponRequest{Code: "Rpg10"}); err != nil {
+		t.Fatalf("ApplyCoupon: %v", err)
+	}
+	if c.GetCouponCode() != "RPG10" || c.GetSubtotal() != 124.98 || c.GetDiscount() != 20.9 || c.GetTotal() != 113.98 {
+		t.Fatalf("unexpected pricing: %v", c)
+	}
+	if ds := c.GetDiscounts(); len(ds) != 2 || ds[0].GetPromotionId() != free.ID.Hex() || ds[0].GetAmount() != 9.9 ||
+		ds[1].GetCode() != "RPG10" || ds[1].GetAmount() != 11 {
+		t.Fatalf("unexpected discounts: %v", ds)
+	}
+	if ds := c.GetItems()[0].GetDiscounts(); len(ds) != 0 {
+		t.Fatalf("unexpected discounts of the dice: %v", ds)
+	}
+	if ds := c.GetItems()[1].GetDiscounts(); len(ds) != 1 || ds[0].GetPromotionId() != rpg.ID.Hex() || c.GetItems()[1].GetTotal() != 109.98 {
+		t.Fatalf("unexpected discounts of the vtm: %v", c.GetItems()[1])
+	}
+
+	_, err = cl.ApplyCoupon(ctx, &CouponRequest{Code: "nope"})
+	assertCode(t, err, codes.NotFound)
+	_, err = cl.ApplyCoupon(ctx, &CouponRequest{Code: "old"})
+	assertCode(t, err, codes.FailedPrecondition)
+
+	if c, err = cl.RemoveCoupon(ctx, &RemoveCouponRequest{}); err != nil {
+		t.Fatalf("RemoveCoupon: %v", err)
+	}
+	if c.GetCouponCode() != "" || c.GetDiscount() != 9.9 || len(c.GetDiscounts()) != 1 {
+		t.Fatalf("expected only the free shipping, got %v", c)
+	}
+}
+
+func TestCheckoutPromotions(t *testing.T) {
+	f, cl := newTestClient(t)
+	once := &MongoPromotion{Name: "5 off", Code: "once", Type: PromotionFixed, Value: 5, MaxUses: 10, MaxUsesPerCustomer: 1}
+	f.store.AddPromotion(once)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "valid")
+	req := &CheckoutRequest{CouponCode: "once", Cart: []*CheckoutRequest_Cart{
+		{Product: &Product{Id: f.vtm.ID.Hex(), Name: f.vtm.Name, Value: 54.99}, Qty: 1},
+	}}
+	res, err := cl.Checkout(ctx, req)
+	if err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+	if !res.GetValue() || res.GetDiscount() != 5 || res.GetTotal() != 49.99 || len(res.GetDiscounts()) != 1 ||
+		res.GetItems()[0].GetDiscounts()[0].GetCode() != "ONCE" {
+		t.Fatalf("unexpected checkout: %v", res)
+	}
+	orders := f.store.Orders()
+	if len(orders) != 1 || orders[0].ID.Hex() != res.GetOrderId() || orders[0].Total != 49.99 || orders[0].Subtotal != 54.99 ||
+		orders[0].Items[0].Discount != 5 || orders[0].Discounts[0].Promotion != once.ID {
+		t.Fatalf("unexpected order: %+v", orders[0])
+	}
+
+	// used once by user-1
+	if res, err = cl.Checkout(ctx, req); err != nil || res.GetDiscount() != 0 || res.GetTotal() != 54.99 {
+		t.Fatalf("Checkout: got %v %v, want no discount", res, err)
+	}
+	f.store.RLock()
+	uses := once.Uses
+	f.store.RUnlock()
+	if uses != 1 {
+		t.Fatalf("got %v uses, want 1", uses)
+	}
+
+	req.CouponCode = "nope"
+	_, err = cl.Checkout(ctx, req)
+	assertCode(t, err, codes.NotFound)
+	_, err = cl.Checkout(ctx, &CheckoutRequest{CartId: NewObjectID().Hex(), CouponCode: "once"})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestRedeemPromotions(t *testing.T) {
+	store := NewMemoryStore()
+	ok := &MongoPromotion{Name: "ok"}
+	gone := &MongoPromotion{Name: "gone", MaxUses: 1, Uses: 1}
+	store.AddPromotion(ok)
+	store.AddPromotion(gone)
+	srv := newServer(store)
+	ctx := context.Background()
+	_, err := srv.redeemPromotions(ctx, &priced{applied: []lineDiscount{{ok, 100}, {gone, 100}}}, "user-1")
+	assertCode(t, err, codes.FailedPrecondition)
+	if ok.Uses != 0 || gone.Uses != 1 {
+		t.Fatalf("expected the uses given back, got %v and %v", ok.Uses, gone.Uses)
+	}
+	release, err := srv.redeemPromotions(ctx, &priced{applied: []lineDiscount{{ok, 100}}}, "user-1")
+	if err != nil || ok.Uses != 1 {
+		t.Fatalf("redeemPromotions: got %v with %v uses", err, ok.Uses)
+	}
+	release()
+	if used, _ := store.Redemptions(ctx, "user-1", []ObjectID{ok.ID}); ok.Uses != 0 || used[ok.ID] != 0 {
+		t.Fatalf("expected the use released, got %v and %v", ok.Uses, used)
+	}
+}
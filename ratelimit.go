@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const retryAfterHeader = "retry-after"
+
+// RateLimit is a token bucket: Rate tokens per second, up to Burst. A zero Rate is unlimited.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// RateLimitStore keeps the token buckets. The memory store limits each instance on
+// its own, the Redis store shares the buckets between the instances.
+type RateLimitStore interface {
+	// Take takes a token of the bucket of the key, returning how long to wait for
+	// the next one when the bucket is empty.
+	Take(ctx context.Context, key string, l RateLimit) (bool, time.Duration, error)
+}
+
+var rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ecomm_rate_limited_total",
+	Help: "Calls rejected by the rate limits, by method.",
+}, []string{"method"})
+
+func init() {
+	prometheus.MustRegister(rateLimited)
+}
+
+// rateLimiter applies the limits of the methods to each user, or to each IP for
+// the anonymous calls.
+type rateLimiter struct {
+	store   RateLimitStore
+	def     RateLimit
+	methods map[string]RateLimit
+}
+
+func newRateLimiter(store RateLimitStore, def RateLimit, methods map[string]RateLimit) *rateLimiter {
+	return &rateLimiter{store: store, def: def, methods: methods}
+}
+
+func (rl *rateLimiter) limitFor(fullMethod string) RateLimit {
+	if l, ok := rl.methods[path.Base(fullMethod)]; ok {
+		return l
+	}
+	return rl.def
+}
+
+// rateLimitInterceptor returns ResourceExhausted, with the retry-after metadata and a
+// RetryInfo, when the caller used all the tokens of the method. Without a limiter, when
+// rate_limit is disabled, it lets every call through.
+func (srv *server) rateLimitInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if srv.limiter == nil {
+		return handler(ctx, req)
+	}
+	l := srv.limiter.limitFor(info.FullMethod)
+	if l.Rate <= 0 {
+		return handler(ctx, req)
+	}
+	method := path.Base(info.FullMethod)
+	ok, wait, err := srv.limiter.store.Take(ctx, method+":"+srv.callerKey(ctx), l)
+	if err != nil {
+		// an unavailable store must not take the shop down with it
+		ctxLogger(ctx).Warn("Rate limit store error", zap.Error(err))
+		return handler(ctx, req)
+	}
+	if ok {
+		return handler(ctx, req)
+	}
+	rateLimited.WithLabelValues(method).Inc()
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(retryAfterHeader, strconv.Itoa(secs)))
+	st := status.New(codes.ResourceExhausted, "Too many requests, retry later")
+	if ds, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait)}); err == nil {
+		st = ds
+	}
+	return nil, st.Err()
+}
+
+// callerKey is the sub of the user when the token is in the cache of the tokens validated
+// by Keycloak, otherwise the IP of the caller, so forged tokens cannot pick their own bucket.
+func (srv *server) callerKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if t := md.Get("x-user-auth-token"); len(t) > 0 {
+		if u, ok := srv.identity.cached(t[0]); ok {
+			return "sub:" + u.Sub
+		}
+	}
+	return "ip:" + callerIP(ctx)
+}
+
+// callerIP is the IP of the peer, or the client IP added by the REST gateway when
+// the peer is the gateway on the loopback.
+func callerIP(ctx context.Context) string {
+	ip := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = p.Addr.String()
+		if h, _, err := net.SplitHostPort(ip); err == nil {
+			ip = h
+		}
+	}
+	if pip := net.ParseIP(ip); pip == nil || !pip.IsLoopback() {
+		return ip
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if xff := md.Get("x-forwarded-for"); len(xff) > 0 {
+		// the gateway appends the address it saw to the ones sent by the client
+		hops := strings.Split(xff[len(xff)-1], ",")
+		if h := strings.TrimSpace(hops[len(hops)-1]); h != "" {
+			return h
+		}
+	}
+	return ip
+}
+
+func tokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// memoryRateLimitStore keeps the buckets of this instance.
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*bucket{}, now: time.Now}
+}
+
+func (m *memoryRateLimitStore) Take(_ context.Context, key string, l RateLimit) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second)), nil
+}
+
+// sweep drops the buckets full again, they are the same as a new bucket.
+func (m *memoryRateLimitStore) sweep(limits func(key string) RateLimit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for k, b := range m.buckets {
+		l := limits(k)
+		if l.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+			delete(m.buckets, k)
+		}
+	}
+}
+
+// sweepBuckets sweeps the memory store every interval until the context is done.
+func (rl *rateLimiter) sweepBuckets(m *memoryRateLimitStore, interval time.Duration) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				m.sweep(func(key string) RateLimit {
+					return rl.limitFor(strings.SplitN(key, ":", 2)[0])
+				})
+			}
+		}
+	}
+}
+
+// tokenBucketScript is the token bucket of the Redis store, atomic on the server.
+// The clock is the one of the instances, kept in sync by NTP.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return wait
+`)
+
+// redisRateLimitStore shares the buckets between the instances. Any client of the
+// go-redis Scripter interface works: a single node, a cluster, a ring, or a Redis
+// compatible server like KeyDB or Dragonfly.
+type redisRateLimitStore struct {
+	client redis.Scripter
+	prefix string
+}
+
+func newRedisRateLimitStore(client redis.Scripter) *redisRateLimitStore {
+	return &redisRateLimitStore{client: client, prefix: "ecomm:ratelimit:"}
+}
+
+func (r *redisRateLimitStore) Take(ctx context.Context, key string, l RateLimit) (bool, time.Duration, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	wait, err := tokenBucketScript.Run(ctx, r.client, []string{r.prefix + key}, l.Rate, l.Burst, now).Int64()
+	if err != nil {
+		return false, 0, fmt.Errorf("redis rate limit: %w", err)
+	}
+	return wait == 0, time.Duration(wait) * time.Millisecond, nil
+}
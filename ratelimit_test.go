@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// limitSearch limits SearchProducts to one call, then one every 10 seconds.
+func limitSearch(s *server) {
+	s.limiter = newRateLimiter(newMemoryRateLimitStore(), RateLimit{}, map[string]RateLimit{
+		"SearchProducts": {Rate: 0.1, Burst: 1},
+	})
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	m := newMemoryRateLimitStore()
+	m.now = func() time.Time { return now }
+	l := RateLimit{Rate: 2, Burst: 2}
+	take := func(key string, want bool, wait time.Duration) {
+		t.Helper()
+		ok, w, err := m.Take(context.Background(), key, l)
+		if err != nil || ok != want || w != wait {
+			t.Fatalf("Take(%v): got %v %v %v, want %v %v", key, ok, w, err, want, wait)
+		}
+	}
+	take("a", true, 0)
+	take("a", true, 0)
+	take("a", false, 500*time.Millisecond)
+	take("b", true, 0)
+	now = now.Add(250 * time.Millisecond)
+	take("a", false, 250*time.Millisecond)
+	now = now.Add(250 * time.Millisecond)
+	take("a", true, 0)
+
+	now = now.Add(time.Second)
+	m.sweep(func(string) RateLimit { return l })
+	if len(m.buckets) != 0 {
+		t.Errorf("sweep kept %v full buckets", len(m.buckets))
+	}
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	r := newRedisRateLimitStore(rdb)
+	l := RateLimit{Rate: 1, Burst: 2}
+	for i, want := range []bool{true, true, false} {
+		ok, wait, err := r.Take(context.Background(), "a", l)
+		if err != nil {
+			t.Fatalf("Take: %v", err)
+		}
+		if ok != want {
+			t.Fatalf("call %v: got %v, want %v", i, ok, want)
+		}
+		if !ok && (wait <= 0 || wait > time.Second) {
+			t.Errorf("wait: got %v", wait)
+		}
+	}
+	if ok, _, _ := r.Take(context.Background(), "b", l); !ok {
+		t.Error("the buckets of the keys are not separated")
+	}
+
+	mr.Close()
+	if _, _, err := r.Take(context.Background(), "a", l); err == nil {
+		t.Error("expected an error with Redis down")
+	}
+}
+
+func TestRateLimitInterceptor(t *testing.T) {
+	var srv *server
+	_, cl := newTestClient(t, limitSearch, func(s *server) { srv = s })
+	ctx := context.Background()
+	req := &SearchProductsRequest{Name: "vampire", Qty: 10}
+
+	if _, err := cl.SearchProducts(ctx, req); err != nil {
+		t.Fatalf("SearchProducts: %v", err)
+	}
+	var hd metadata.MD
+	_, err := cl.SearchProducts(ctx, req, grpc.Header(&hd))
+	assertCode(t, err, codes.ResourceExhausted)
+	if ra := hd.Get("retry-after"); len(ra) != 1 || ra[0] != "10" {
+		t.Errorf("retry-after: got %v", ra)
+	}
+	var ri *errdetails.RetryInfo
+	for _, d := range status.Convert(err).Details() {
+		if r, ok := d.(*errdetails.RetryInfo); ok {
+			ri = r
+		}
+	}
+	if d := ri.GetRetryDelay().AsDuration(); d <= 9*time.Second || d > 10*time.Second {
+		t.Errorf("RetryInfo: got %v", ri)
+	}
+
+	// the other methods and the known users have their own buckets
+	if _, err := cl.Products(ctx, &ProductRequest{Qty: 10}); err != nil {
+		t.Errorf("Products: %v", err)
+	}
+	srv.identity.store("valid", &Body{Sub: "user-1"})
+	authCtx := metadata.AppendToOutgoingContext(ctx, "x-user-auth-token", "valid")
+	if _, err := cl.SearchProducts(authCtx, req); err != nil {
+		t.Errorf("SearchProducts of a known user: %v", err)
+	}
+	forgedCtx := metadata.AppendToOutgoingContext(ctx, "x-user-auth-token", "forged")
+	_, err = cl.SearchProducts(forgedCtx, req)
+	assertCode(t, err, codes.ResourceExhausted)
+}
+
+func TestRateLimitGateway(t *testing.T) {
+	_, hs := newTestGateway(t, limitSearch)
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r, err := http.Get(hs.URL + "/v1/products/search?name=vampire&qty=10")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != want {
+			t.Fatalf("got status %v, want %v", r.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests && r.Header.Get("Retry-After") != "10" {
+			t.Errorf("Retry-After: got %q", r.Header.Get("Retry-After"))
+		}
+	}
+}
+
+func TestCallerIP(t *testing.T) {
+	for _, tt := range []struct {
+		peer string
+		xff  []string
+		want string
+	}{
+		{"203.0.113.7:4242", nil, "203.0.113.7"},
+		{"203.0.113.7:4242", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"127.0.0.1:4242", []string{"10.0.0.1, 198.51.100.1"}, "198.51.100.1"},
+		{"[::1]:4242", nil, "::1"},
+	} {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: tcpAddr(t, tt.peer)})
+		if tt.xff != nil {
+			ctx = metadata.NewIncomingContext(ctx, metadata.MD{"x-forwarded-for": tt.xff})
+		}
+		if got := callerIP(ctx); got != tt.want {
+			t.Errorf("callerIP(%v, %v): got %v, want %v", tt.peer, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func tcpAddr(t *testing.T, s string) net.Addr {
+	a, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recoveryInterceptor turns a panic in a handler into an Internal error, logging the
+// stack trace, instead of killing the server.
+func recoveryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ctxLogger(ctx).Error("Panic", zap.String("method", info.FullMethod), zap.Any("panic", r), zap.ByteString("stack", debug.Stack()))
+			err = status.Errorf(codes.Internal, "Unknown Internal Error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+func streamRecoveryInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ctxLogger(ss.Context()).Error("Panic", zap.String("method", info.FullMethod), zap.Any("panic", r), zap.ByteString("stack", debug.Stack()))
+			err = status.Errorf(codes.Internal, "Unknown Internal Error")
+		}
+	}()
+	return handler(srv, ss)
+}
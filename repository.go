@@ -0,0 +1,677 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrCategoryNotFound = errors.New("category not found")
+
+var (
+	ErrCartNotFound = errors.New("cart not found")
+	// ErrCartConflict is a cart saved by another call since it was read.
+	ErrCartConflict = errors.New("cart changed concurrently")
+)
+
+var (
+	ErrPromotionNotFound = errors.New("promotion not found")
+	// ErrPromotionExhausted is a promotion used as many times as its limits allow.
+	ErrPromotionExhausted = errors.New("promotion exhausted")
+)
+
+type CategoryRepository interface {
+	// RootCategories returns the categories without ancestors, with their direct subcategories.
+	RootCategories(ctx context.Context) ([]*MongoCategories, error)
+	// CategoriesBySlug returns the categories with the slug, in any locale, with their
+	// parents and direct subcategories.
+	CategoriesBySlug(ctx context.Context, slug string) ([]*MongoCategories, error)
+	AllCategories(ctx context.Context) ([]*MongoCategories, error)
+	// CategoriesWithDescendants returns every category with all the subcategories below it, at any depth.
+	CategoriesWithDescendants(ctx context.Context) ([]*MongoCategories, error)
+	// Descendants returns the ids of all the subcategories below the category, at any depth.
+	Descendants(ctx context.Context, id ObjectID) ([]ObjectID, error)
+}
+
+// ProductFilter selects the products of a listing, empty fields match everything.
+type ProductFilter struct {
+	Categories []ObjectID
+	Name       string
+}
+
+type ProductRepository interface {
+	// ListProducts returns a page of the products sorted by name, with their category in Cat.
+	ListProducts(ctx context.Context, f ProductFilter, start, qty int32) (*MongoProducts, error)
+	// CountProducts returns the number of products, and in stock products, of each category.
+	CountProducts(ctx context.Context) (map[ObjectID]CategoryCount, error)
+	// ProductsByIDs returns the products with the ids, without their category, skipping the unknown ones.
+	ProductsByIDs(ctx context.Context, ids []ObjectID) ([]*MongoProductsData, error)
+}
+
+type OrderRepository interface {
+	CreateOrder(ctx context.Context, o *MongoOrder) (ObjectID, error)
+}
+
+// CartRepository keeps the server-side carts, of a user or anonymous with a token.
+type CartRepository interface {
+	CartByID(ctx context.Context, id ObjectID) (*MongoCart, error)
+	CartByUser(ctx context.Context, userID string) (*MongoCart, error)
+	// CartByToken finds the anonymous cart by the hash of its token.
+	CartByToken(ctx context.Context, tokenHash string) (*MongoCart, error)
+	// SaveCart inserts a new cart, or replaces the cart when its version did not change
+	// since it was read, returning ErrCartConflict otherwise. It increments the version.
+	SaveCart(ctx context.Context, c *MongoCart) error
+	DeleteCart(ctx context.Context, id ObjectID) error
+}
+
+// PromotionRepository keeps the promotions and counts their uses.
+type PromotionRepository interface {
+	// ActivePromotions returns the promotions without a coupon code valid at the time.
+	ActivePromotions(ctx context.Context, at time.Time) ([]*MongoPromotion, error)
+	// PromotionByCode finds the promotion of the coupon code, ignoring the case.
+	PromotionByCode(ctx context.Context, code string) (*MongoPromotion, error)
+	// Redemptions returns how many times the user used each of the promotions.
+	Redemptions(ctx context.Context, userID string, ids []ObjectID) (map[ObjectID]int64, error)
+	// RedeemPromotion counts a use of the promotion by the user, returning
+	// ErrPromotionExhausted when it would go over the global or the per-customer limit.
+	RedeemPromotion(ctx context.Context, p *MongoPromotion, userID string) error
+	// ReleasePromotion gives back a use counted by RedeemPromotion.
+	ReleasePromotion(ctx context.Context, p *MongoPromotion, userID string) error
+}
+
+// Store is every repository of the server, the MongoDB or the in-memory store.
+type Store interface {
+	CategoryRepository
+	ProductRepository
+	OrderRepository
+	CartRepository
+	PromotionRepository
+}
+
+// The promotion types.
+const (
+	PromotionPercentage   = "PERCENTAGE"
+	PromotionFixed        = "FIXED"
+	PromotionFreeShipping = "FREE_SHIPPING"
+	PromotionBuyXGetY     = "BUY_X_GET_Y"
+)
+
+// MongoPromotion is a discount on the lines of its products and categories, all the
+// lines when it has none, or on the shipping.
+type MongoPromotion struct {
+	ID   ObjectID `bson:"_id,omitempty"`
+	Name string   `bson:"name,omitempty"`
+	// Code is the coupon code, stored upper case, empty to apply it automatically.
+	Code string `bson:"code,omitempty"`
+	Type string `bson:"type"`
+	// Value is the percentage of PERCENTAGE and the amount of FIXED, split between the lines.
+	Value float64 `bson:"value,omitempty"`
+	// BuyQty and GetQty are the quantities of BUY_X_GET_Y: of every BuyQty+GetQty
+	// units of a product, GetQty are free.
+	BuyQty     int32      `bson:"buy_qty,omitempty"`
+	GetQty     int32      `bson:"get_qty,omitempty"`
+	Products   []ObjectID `bson:"products,omitempty"`
+	Categories []ObjectID `bson:"categories,omitempty"`
+	// MinCartValue is the subtotal of the cart needed, before any discount.
+	MinCartValue float64   `bson:"min_cart_value,omitempty"`
+	StartsAt     time.Time `bson:"starts_at,omitempty"`
+	EndsAt       time.Time `bson:"ends_at,omitempty"`
+	// MaxUses and MaxUsesPerCustomer limit the orders with the promotion, 0 is unlimited.
+	MaxUses            int64 `bson:"max_uses,omitempty"`
+	MaxUsesPerCustomer int64 `bson:"max_uses_per_customer,omitempty"`
+	Uses               int64 `bson:"uses"`
+	// Priority orders the promotions, the highest first, then by id.
+	Priority int32 `bson:"priority,omitempty"`
+}
+
+// active tells if the promotion is valid at the time and not used up.
+func (p *MongoPromotion) active(at time.Time) bool {
+	return (p.StartsAt.IsZero() || !at.Before(p.StartsAt)) &&
+		(p.EndsAt.IsZero() || at.Before(p.EndsAt)) &&
+		(p.MaxUses == 0 || p.Uses < p.MaxUses)
+}
+
+type MongoCart struct {
+	ID     ObjectID `bson:"_id,omitempty"`
+	UserID string   `bson:"user_id,omitempty"`
+	// TokenHash is the SHA-256 of the token of the anonymous carts, the token is never stored.
+	TokenHash string          `bson:"token_hash,omitempty"`
+	Items     []MongoCartItem `bson:"items"`
+	// Merged are the last anonymous carts merged into the cart, so a retried merge does not add them twice.
+	Merged []ObjectID `bson:"merged,omitempty"`
+	// Coupon is the coupon code applied to the cart.
+	Coupon string `bson:"coupon,omitempty"`
+	// Destination is where the cart is shipped, for the taxes.
+	Destination TaxDestination `bson:"destination,omitempty"`
+	Version     int64          `bson:"version"`
+	UpdatedAt   time.Time      `bson:"updated_at,omitempty"`
+}
+
+type MongoCartItem struct {
+	Product  ObjectID  `bson:"product"`
+	Quantity int32     `bson:"quantity"`
+	AddedAt  time.Time `bson:"added_at,omitempty"`
+}
+
+type MongoOrder struct {
+	ID       ObjectID         `bson:"_id,omitempty"`
+	UserID   string           `bson:"user_id,omitempty"`
+	Name     string           `bson:"name,omitempty"`
+	Email    string           `bson:"email,omitempty"`
+	Items    []MongoOrderItem `bson:"items,omitempty"`
+	Subtotal float64          `bson:"subtotal,omitempty"`
+	Discount float64          `bson:"discount,omitempty"`
+	Shipping float64          `bson:"shipping,omitempty"`
+	Tax      float64          `bson:"tax,omitempty"`
+	// TaxIncluded tells the tax is part of the values, and not added to the total.
+	TaxIncluded bool `bson:"tax_included,omitempty"`
+	// Total is the subtotal less the discount plus the shipping, plus the tax when it is
+	// not included.
+	Total float64 `bson:"total,omitempty"`
+	// Discounts has the total of each promotion applied and Taxes of each tax, for the invoice.
+	Discounts   []MongoOrderDiscount `bson:"discounts,omitempty"`
+	Taxes       []MongoOrderTax      `bson:"taxes,omitempty"`
+	Destination TaxDestination       `bson:"destination,omitempty"`
+	CreatedAt   time.Time            `bson:"created_at,omitempty"`
+}
+
+type MongoOrderItem struct {
+	Product   ObjectID             `bson:"product,omitempty"`
+	Name      string               `bson:"name,omitempty"`
+	Quantity  int32                `bson:"quantity,omitempty"`
+	Value     float64              `bson:"value,omitempty"`
+	Discount  float64              `bson:"discount,omitempty"`
+	Discounts []MongoOrderDiscount `bson:"discounts,omitempty"`
+	// Tax is the tax of the line after the discounts.
+	Tax float64 `bson:"tax,omitempty"`
+}
+
+type MongoOrderDiscount struct {
+	Promotion ObjectID `bson:"promotion"`
+	Name      string   `bson:"name,omitempty"`
+	Code      string   `bson:"code,omitempty"`
+	Amount    float64  `bson:"amount"`
+}
+
+type MongoOrderTax struct {
+	Name   string  `bson:"name"`
+	Rate   float64 `bson:"rate"`
+	Amount float64 `bson:"amount"`
+}
+
+// MongoStore implements the repositories with the MongoDB collections.
+type MongoStore struct {
+	categories *mongo.Collection
+	products   *mongo.Collection
+	orders     *mongo.Collection
+	carts      *mongo.Collection
+	promotions *mongo.Collection
+	// redemptions has the uses of each promotion by each user.
+	redemptions *mongo.Collection
+}
+
+func NewMongoStore(db *mongo.Database) *MongoStore {
+	return &MongoStore{
+		categories:  db.Collection("categories"),
+		products:    db.Collection("products"),
+		orders:      db.Collection("orders"),
+		carts:       db.Collection("carts"),
+		promotions:  db.Collection("promotions"),
+		redemptions: db.Collection("promotion_redemptions"),
+	}
+}
+
+// anonymousCartTTL is how long the anonymous carts are kept after their last change.
+const anonymousCartTTL = 30 * 24 * time.Hour
+
+// EnsureIndexes creates the indexes of the carts: one cart by user and by token, and the
+// expiration of the abandoned anonymous carts; and of the promotions: one by coupon code
+// and one count of uses by user.
+func (m *MongoStore) EnsureIndexes(ctx context.Context) error {
+	_, err := m.carts.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{E{Key: "user_id", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.D{E{Key: "user_id", Value: bson.D{E{Key: "$exists", Value: true}}}}),
+		},
+		{
+			Keys: bson.D{E{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.D{E{Key: "token_hash", Value: bson.D{E{Key: "$exists", Value: true}}}}),
+		},
+		{
+			Keys: bson.D{E{Key: "updated_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(anonymousCartTTL.Seconds())).
+				// the partial indexes take no $exists: false, the anonymous carts are the ones with a token
+				SetPartialFilterExpression(bson.D{E{Key: "token_hash", Value: bson.D{E{Key: "$exists", Value: true}}}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = m.promotions.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{E{Key: "code", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.D{E{Key: "code", Value: bson.D{E{Key: "$exists", Value: true}}}}),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = m.redemptions.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{E{Key: "promotion", Value: 1}, E{Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// descendantsLookupStage expands every subcategory below a category, at any depth.
+func descendantsLookupStage() bson.D {
+	return bson.D{
+		E{Key: "$graphLookup", Value: bson.D{
+			E{Key: "from", Value: "categories"},
+			E{Key: "startWith", Value: "$childrens"},
+			E{Key: "connectFromField", Value: "childrens"},
+			E{Key: "connectToField", Value: "_id"},
+			E{Key: "as", Value: "subcategories"},
+		}}}
+}
+
+// aggregateCategories runs the pipeline on the categories, name is the pipeline of the metrics.
+func (m *MongoStore) aggregateCategories(ctx context.Context, name string, pipeline mongo.Pipeline) (_ []*MongoCategories, err error) {
+	ctx, end := startQuery(ctx, name, m.categories, "aggregate", pipeline)
+	defer end(&err)
+	cur, err := m.categories.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	ds := []*MongoCategories{}
+	for cur.Next(ctx) {
+		d := &MongoCategories{}
+		if err := cur.Decode(d); err != nil {
+			return nil, fmt.Errorf("cannot decoding data: %v", err)
+		}
+		ds = append(ds, d)
+	}
+	if err = cur.Err(); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+func (m *MongoStore) RootCategories(ctx context.Context) ([]*MongoCategories, error) {
+	matchStage := bson.D{E{Key: "$match", Value: bson.D{
+		E{Key: "ancestors", Value: nil},
+	}}}
+	graphLookupStage := bson.D{
+		E{Key: "$graphLookup", Value: bson.D{
+			E{Key: "from", Value: "categories"},
+			E{Key: "startWith", Value: "$childrens"},
+			E{Key: "connectFromField", Value: "childrens"},
+			E{Key: "connectToField", Value: "_id"},
+			E{Key: "maxDepth", Value: 0},
+			E{Key: "as", Value: "subcategories"},
+		}}}
+	return m.aggregateCategories(ctx, "menu", mongo.Pipeline{matchStage, graphLookupStage})
+}
+
+func (m *MongoStore) CategoriesBySlug(ctx context.Context, slug string) ([]*MongoCategories, error) {
+	matchStage := bson.D{E{Key: "$match", Value: slugFilter(slug)}}
+	parentsLookupStage := bson.D{
+		E{Key: "$graphLookup", Value: bson.D{
+			E{Key: "from", Value: "categories"},
+			E{Key: "startWith", Value: "$ancestors"},
+			E{Key: "connectFromField", Value: "ancestors"},
+			E{Key: "connectToField", Value: "_id"},
+			E{Key: "maxDepth", Value: 0},
+			E{Key: "as", Value: "parents"},
+		}}}
+	childrensLookupStage := bson.D{
+		E{Key: "$graphLookup", Value: bson.D{
+			E{Key: "from", Value: "categories"},
+			E{Key: "startWith", Value: "$childrens"},
+			E{Key: "connectFromField", Value: "childrens"},
+			E{Key: "connectToField", Value: "_id"},
+			E{Key: "maxDepth", Value: 0},
+			E{Key: "as", Value: "subcategories"},
+		}}}
+	return m.aggregateCategories(ctx, "breadcrumb", mongo.Pipeline{matchStage, parentsLookupStage, childrensLookupStage})
+}
+
+func (m *MongoStore) AllCategories(ctx context.Context) ([]*MongoCategories, error) {
+	return m.aggregateCategories(ctx, "tree", mongo.Pipeline{})
+}
+
+func (m *MongoStore) CategoriesWithDescendants(ctx context.Context) ([]*MongoCategories, error) {
+	return m.aggregateCategories(ctx, "counts", mongo.Pipeline{descendantsLookupStage()})
+}
+
+func (m *MongoStore) Descendants(ctx context.Context, id ObjectID) ([]ObjectID, error) {
+	matchStage := bson.D{E{Key: "$match", Value: bson.D{
+		E{Key: "_id", Value: id},
+	}}}
+	ds, err := m.aggregateCategories(ctx, "descendants", mongo.Pipeline{matchStage, descendantsLookupStage()})
+	if err != nil {
+		return nil, err
+	}
+	if len(ds) == 0 {
+		return nil, ErrCategoryNotFound
+	}
+	cats := []ObjectID{}
+	for _, cat := range ds[0].Subcategories {
+		cats = append(cats, cat.ID)
+	}
+	return cats, nil
+}
+
+func (m *MongoStore) ListProducts(ctx context.Context, f ProductFilter, start, qty int32) (_ *MongoProducts, err error) {
+	name := "listing"
+	if f.Name != "" {
+		name = "search"
+	}
+	pipeline := mongo.Pipeline{}
+	search := bson.D{}
+	if len(f.Categories) > 0 {
+		arr := []bson.D{}
+		for _, i := range f.Categories {
+			arr = append(arr, bson.D{E{Key: "category", Value: i}})
+		}
+		search = append(search, E{Key: "$or", Value: arr})
+	}
+	if f.Name != "" {
+		search = append(search, E{Key: "$and", Value: []bson.D{{E{Key: "$or", Value: []bson.D{
+			{E{Key: "name", Value: Regex{Pattern: f.Name, Options: "i"}}},
+			{E{Key: "translations.name", Value: Regex{Pattern: f.Name, Options: "i"}}},
+		}}}}})
+	}
+	if len(search) > 0 {
+		pipeline = append(pipeline, bson.D{E{Key: "$match", Value: search}})
+	}
+	sortStage := bson.D{E{Key: "$sort", Value: bson.D{E{Key: "name", Value: 1}}}}
+	graphLookupStage := bson.D{
+		E{Key: "$graphLookup", Value: bson.D{
+			E{Key: "from", Value: "categories"},
+			E{Key: "startWith", Value: "$category"},
+			E{Key: "connectFromField", Value: "category"},
+			E{Key: "connectToField", Value: "_id"},
+			E{Key: "maxDepth", Value: 0},
+			E{Key: "as", Value: "cat"},
+		}}}
+	facetStage := bson.D{
+		E{Key: "$facet", Value: bson.D{
+			E{Key: "metadata", Value: []bson.D{{E{Key: "$count", Value: "total"}}}},
+			E{Key: "data", Value: []bson.D{{E{Key: "$skip", Value: start}}, {E{Key: "$limit", Value: qty}}}},
+		}},
+	}
+	pipeline = append(pipeline, sortStage, graphLookupStage, facetStage)
+	ctx, end := startQuery(ctx, name, m.products, "aggregate", pipeline)
+	defer end(&err)
+	cur, err := m.products.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	d := &MongoProducts{}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		if err := cur.Decode(d); err != nil {
+			return nil, fmt.Errorf("cannot decoding data: %v", err)
+		}
+	}
+	if err = cur.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (m *MongoStore) CountProducts(ctx context.Context) (_ map[ObjectID]CategoryCount, err error) {
+	groupStage := bson.D{E{Key: "$group", Value: bson.D{
+		E{Key: "_id", Value: "$category"},
+		E{Key: "total", Value: bson.D{E{Key: "$sum", Value: 1}}},
+		E{Key: "in_stock", Value: bson.D{E{Key: "$sum", Value: bson.D{
+			E{Key: "$cond", Value: bson.A{bson.D{E{Key: "$gt", Value: bson.A{"$quantity", 0}}}, 1, 0}},
+		}}}},
+	}}}
+	ctx, end := startQuery(ctx, "counts", m.products, "aggregate", mongo.Pipeline{groupStage})
+	defer end(&err)
+	cur, err := m.products.Aggregate(ctx, mongo.Pipeline{groupStage})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	counts := map[ObjectID]CategoryCount{}
+	for cur.Next(ctx) {
+		d := &MongoProductCount{}
+		if err := cur.Decode(d); err != nil {
+			return nil, fmt.Errorf("cannot decoding data: %v", err)
+		}
+		counts[d.ID] = CategoryCount{Total: d.Total, InStock: d.InStock}
+	}
+	if err = cur.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func (m *MongoStore) ProductsByIDs(ctx context.Context, ids []ObjectID) (_ []*MongoProductsData, err error) {
+	ctx, end := startQuery(ctx, "stock", m.products, "find", nil)
+	defer end(&err)
+	cur, err := m.products.Find(ctx, bson.D{E{Key: "_id", Value: bson.D{E{Key: "$in", Value: ids}}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	ps := []*MongoProductsData{}
+	for cur.Next(ctx) {
+		p := &MongoProductsData{}
+		if err := cur.Decode(p); err != nil {
+			return nil, fmt.Errorf("cannot decoding data: %v", err)
+		}
+		ps = append(ps, p)
+	}
+	if err = cur.Err(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func (m *MongoStore) CreateOrder(ctx context.Context, o *MongoOrder) (_ ObjectID, err error) {
+	ctx, end := startQuery(ctx, "order", m.orders, "insert", nil)
+	defer end(&err)
+	res, err := m.orders.InsertOne(ctx, o)
+	if err != nil {
+		return NilObjectID, err
+	}
+	id, _ := res.InsertedID.(ObjectID)
+	return id, nil
+}
+
+func (m *MongoStore) findCart(ctx context.Context, filter bson.D) (_ *MongoCart, err error) {
+	ctx, end := startQuery(ctx, "cart", m.carts, "find", nil)
+	defer end(&err)
+	c := &MongoCart{}
+	err = m.carts.FindOne(ctx, filter).Decode(c)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrCartNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (m *MongoStore) CartByID(ctx context.Context, id ObjectID) (*MongoCart, error) {
+	return m.findCart(ctx, bson.D{E{Key: "_id", Value: id}})
+}
+
+func (m *MongoStore) CartByUser(ctx context.Context, userID string) (*MongoCart, error) {
+	return m.findCart(ctx, bson.D{E{Key: "user_id", Value: userID}})
+}
+
+func (m *MongoStore) CartByToken(ctx context.Context, tokenHash string) (*MongoCart, error) {
+	return m.findCart(ctx, bson.D{E{Key: "token_hash", Value: tokenHash}})
+}
+
+func (m *MongoStore) SaveCart(ctx context.Context, c *MongoCart) (err error) {
+	ctx, end := startQuery(ctx, "cart", m.carts, "save", nil)
+	defer end(&err)
+	n := *c
+	n.Version++
+	n.UpdatedAt = time.Now()
+	if c.ID.IsZero() {
+		n.ID = NewObjectID()
+		if _, err := m.carts.InsertOne(ctx, &n); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return ErrCartConflict
+			}
+			return err
+		}
+	} else {
+		res, err := m.carts.ReplaceOne(ctx, bson.D{E{Key: "_id", Value: c.ID}, E{Key: "version", Value: c.Version}}, &n)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return ErrCartConflict
+		}
+	}
+	*c = n
+	return nil
+}
+
+func (m *MongoStore) DeleteCart(ctx context.Context, id ObjectID) (err error) {
+	ctx, end := startQuery(ctx, "cart", m.carts, "delete", nil)
+	defer end(&err)
+	_, err = m.carts.DeleteOne(ctx, bson.D{E{Key: "_id", Value: id}})
+	return err
+}
+
+func (m *MongoStore) ActivePromotions(ctx context.Context, at time.Time) (_ []*MongoPromotion, err error) {
+	filter := bson.D{
+		E{Key: "code", Value: bson.D{E{Key: "$exists", Value: false}}},
+		E{Key: "$and", Value: bson.A{
+			bson.D{E{Key: "$or", Value: bson.A{
+				bson.D{E{Key: "starts_at", Value: bson.D{E{Key: "$exists", Value: false}}}},
+				bson.D{E{Key: "starts_at", Value: bson.D{E{Key: "$lte", Value: at}}}},
+			}}},
+			bson.D{E{Key: "$or", Value: bson.A{
+				bson.D{E{Key: "ends_at", Value: bson.D{E{Key: "$exists", Value: false}}}},
+				bson.D{E{Key: "ends_at", Value: bson.D{E{Key: "$gt", Value: at}}}},
+			}}},
+		}},
+	}
+	ctx, end := startQuery(ctx, "promotion", m.promotions, "find", nil)
+	defer end(&err)
+	cur, err := m.promotions.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	ps := []*MongoPromotion{}
+	for cur.Next(ctx) {
+		p := &MongoPromotion{}
+		if err := cur.Decode(p); err != nil {
+			return nil, fmt.Errorf("cannot decoding data: %v", err)
+		}
+		if p.active(at) {
+			ps = append(ps, p)
+		}
+	}
+	return ps, cur.Err()
+}
+
+func (m *MongoStore) PromotionByCode(ctx context.Context, code string) (_ *MongoPromotion, err error) {
+	ctx, end := startQuery(ctx, "promotion", m.promotions, "find", nil)
+	defer end(&err)
+	p := &MongoPromotion{}
+	err = m.promotions.FindOne(ctx, bson.D{E{Key: "code", Value: strings.ToUpper(code)}}).Decode(p)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPromotionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type mongoRedemption struct {
+	Promotion ObjectID `bson:"promotion"`
+	UserID    string   `bson:"user_id"`
+	Uses      int64    `bson:"uses"`
+}
+
+func (m *MongoStore) Redemptions(ctx context.Context, userID string, ids []ObjectID) (_ map[ObjectID]int64, err error) {
+	ctx, end := startQuery(ctx, "promotion", m.redemptions, "find", nil)
+	defer end(&err)
+	cur, err := m.redemptions.Find(ctx, bson.D{
+		E{Key: "user_id", Value: userID},
+		E{Key: "promotion", Value: bson.D{E{Key: "$in", Value: ids}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	res := map[ObjectID]int64{}
+	for cur.Next(ctx) {
+		r := &mongoRedemption{}
+		if err := cur.Decode(r); err != nil {
+			return nil, fmt.Errorf("cannot decoding data: %v", err)
+		}
+		res[r.Promotion] = r.Uses
+	}
+	return res, cur.Err()
+}
+
+func (m *MongoStore) RedeemPromotion(ctx context.Context, p *MongoPromotion, userID string) (err error) {
+	ctx, end := startQuery(ctx, "promotion", m.promotions, "redeem", nil)
+	defer end(&err)
+	if userID != "" {
+		// the upsert of a user at the limit inserts a duplicate, rejected by the unique index
+		filter := bson.D{E{Key: "promotion", Value: p.ID}, E{Key: "user_id", Value: userID}}
+		if p.MaxUsesPerCustomer > 0 {
+			filter = append(filter, E{Key: "uses", Value: bson.D{E{Key: "$lt", Value: p.MaxUsesPerCustomer}}})
+		}
+		_, err := m.redemptions.UpdateOne(ctx, filter,
+			bson.D{E{Key: "$inc", Value: bson.D{E{Key: "uses", Value: 1}}}}, options.Update().SetUpsert(true))
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrPromotionExhausted
+		}
+		if err != nil {
+			return err
+		}
+	}
+	filter := bson.D{E{Key: "_id", Value: p.ID}}
+	if p.MaxUses > 0 {
+		filter = append(filter, E{Key: "uses", Value: bson.D{E{Key: "$lt", Value: p.MaxUses}}})
+	}
+	res, err := m.promotions.UpdateOne(ctx, filter, bson.D{E{Key: "$inc", Value: bson.D{E{Key: "uses", Value: 1}}}})
+	if err == nil && res.MatchedCount == 0 {
+		err = ErrPromotionExhausted
+	}
+	if err != nil && userID != "" {
+		m.redemptions.UpdateOne(ctx, bson.D{E{Key: "promotion", Value: p.ID}, E{Key: "user_id", Value: userID}},
+			bson.D{E{Key: "$inc", Value: bson.D{E{Key: "uses", Value: -1}}}})
+	}
+	return err
+}
+
+func (m *MongoStore) ReleasePromotion(ctx context.Context, p *MongoPromotion, userID string) (err error) {
+	ctx, end := startQuery(ctx, "promotion", m.promotions, "release", nil)
+	defer end(&err)
+	if _, err := m.promotions.UpdateOne(ctx, bson.D{E{Key: "_id", Value: p.ID}},
+		bson.D{E{Key: "$inc", Value: bson.D{E{Key: "uses", Value: -1}}}}); err != nil {
+		return err
+	}
+	if userID == "" {
+		return nil
+	}
+	_, err = m.redemptions.UpdateOne(ctx, bson.D{E{Key: "promotion", Value: p.ID}, E{Key: "user_id", Value: userID}},
+		bson.D{E{Key: "$inc", Value: bson.D{E{Key: "uses", Value: -1}}}})
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// workerGroup runs the background workers, like the cache watchers, until Stop.
+type workerGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func newWorkerGroup() *workerGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workerGroup{ctx: ctx, cancel: cancel}
+}
+
+func (w *workerGroup) Go(fn func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("Background worker panic", zap.Any("panic", r), zap.ByteString("stack", debug.Stack()))
+				w.mu.Lock()
+				w.err = fmt.Errorf("background worker panic: %v", r)
+				w.mu.Unlock()
+			}
+		}()
+		fn(w.ctx)
+	}()
+}
+
+// Err returns why the workers are not healthy: a worker panicked or the group was stopped.
+func (w *workerGroup) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if w.ctx.Err() != nil {
+		return errors.New("background workers stopped")
+	}
+	return nil
+}
+
+// Stop cancels the workers and waits for them, returning false if they did not
+// finish before the timeout.
+func (w *workerGroup) Stop(timeout time.Duration) bool {
+	w.cancel()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// gracefulStop waits for the in-flight calls to finish, stopping the server
+// anyway after the timeout. It returns false when the calls were cut.
+func gracefulStop(s *grpc.Server, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		s.Stop()
+		<-done
+		return false
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestWorkerGroupStop(t *testing.T) {
+	w := newWorkerGroup()
+	stopped := make(chan struct{})
+	w.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	})
+	if !w.Stop(time.Second) {
+		t.Fatal("Stop timed out")
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("worker did not stop")
+	}
+
+	w = newWorkerGroup()
+	w.Go(func(ctx context.Context) { time.Sleep(time.Second) })
+	if w.Stop(10 * time.Millisecond) {
+		t.Fatal("Stop did not time out")
+	}
+}
+
+func TestGracefulStop(t *testing.T) {
+	l := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	RegisterEcommServiceServer(s, newServer(NewMemoryStore()))
+	go s.Serve(l)
+	if !gracefulStop(s, time.Second) {
+		t.Fatal("gracefulStop timed out without in-flight calls")
+	}
+}
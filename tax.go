@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultTaxClass is the tax class of the products without one.
+const defaultTaxClass = "standard"
+
+// TaxCalculator computes the taxes of the lines of an order and of its shipping.
+type TaxCalculator interface {
+	Calculate(ctx context.Context, dest TaxDestination, lines []TaxableLine, shipping int64) (*TaxResult, error)
+}
+
+// TaxDestination is where the order is shipped: the ISO 3166-1 alpha-2 country and
+// the subdivision code.
+type TaxDestination struct {
+	Country string `yaml:"country" bson:"country,omitempty"`
+	Region  string `yaml:"region" bson:"region,omitempty"`
+}
+
+// IsZero tells there is no destination, it also leaves it out of the documents.
+func (d TaxDestination) IsZero() bool {
+	return d.Country == "" && d.Region == ""
+}
+
+// TaxableLine is an amount to tax, after the discounts, in cents.
+type TaxableLine struct {
+	TaxClass string
+	Amount   int64
+}
+
+// Tax is the total of a tax in cents, a line of the invoice.
+type Tax struct {
+	Name   string
+	Rate   float64
+	Amount int64
+}
+
+type TaxResult struct {
+	// Lines has the tax of each line and Shipping the tax of the shipping, in cents.
+	Lines    []int64
+	Shipping int64
+	Taxes    []Tax
+	Total    int64
+	// Included tells the amounts already had the taxes, they are not added to the total.
+	Included bool
+}
+
+// noTaxes is the calculator without a rules file.
+type noTaxes struct{}
+
+func (noTaxes) Calculate(ctx context.Context, dest TaxDestination, lines []TaxableLine, shipping int64) (*TaxResult, error) {
+	return &TaxResult{Lines: make([]int64, len(lines)), Taxes: []Tax{}}, nil
+}
+
+// TaxRule is a tax of the products of the class shipped to the country and the region,
+// every class and every region of the country when they are empty.
+type TaxRule struct {
+	Country string `yaml:"country"`
+	Region  string `yaml:"region"`
+	Class   string `yaml:"class"`
+	Name    string `yaml:"name"`
+	// Rate is the percentage.
+	Rate float64 `yaml:"rate"`
+}
+
+// TaxRules is the rules file. The rules of a destination with different names add up,
+// e.g. a state and a county tax; of the rules with the same name, the one with a region
+// wins over the one without, then the one with a class, then the first in the file.
+type TaxRules struct {
+	// Included tells the values of the products already include the taxes.
+	Included bool `yaml:"included"`
+	// ShippingClass is the tax class of the shipping, empty when it is not taxed.
+	ShippingClass string    `yaml:"shipping_class"`
+	Rules         []TaxRule `yaml:"rules"`
+}
+
+// loadTaxRules reads and checks the YAML rules file.
+func loadTaxRules(file string) (*TaxRules, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading tax rules: %v", err)
+	}
+	r := &TaxRules{}
+	if err := yaml.UnmarshalStrict(b, r); err != nil {
+		return nil, fmt.Errorf("parsing tax rules %v: %v", file, err)
+	}
+	errs := []string{}
+	for i, rule := range r.Rules {
+		if len(rule.Country) != 2 || strings.ToUpper(rule.Country) != rule.Country {
+			errs = append(errs, fmt.Sprintf("rules[%d].country must be an upper case ISO 3166-1 alpha-2 code", i))
+		}
+		if rule.Name == "" {
+			errs = append(errs, fmt.Sprintf("rules[%d].name is required", i))
+		}
+		if rule.Rate < 0 || rule.Rate > 100 {
+			errs = append(errs, fmt.Sprintf("rules[%d].rate must be between 0 and 100", i))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.New("invalid tax rules:\n  " + strings.Join(errs, "\n  "))
+	}
+	return r, nil
+}
+
+// rates returns the rules of the destination and the class, one by name.
+func (r *TaxRules) rates(dest TaxDestination, class string) []TaxRule {
+	res := []TaxRule{}
+	best := map[string]int{}
+	for _, rule := range r.Rules {
+		if rule.Country != dest.Country || (rule.Region != "" && rule.Region != dest.Region) || (rule.Class != "" && rule.Class != class) {
+			continue
+		}
+		i, ok := best[rule.Name]
+		switch {
+		case !ok:
+			best[rule.Name] = len(res)
+			res = append(res, rule)
+		case specificity(rule) > specificity(res[i]):
+			res[i] = rule
+		}
+	}
+	return res
+}
+
+// specificity ranks the rules with the same name: a region counts more than a class.
+func specificity(rule TaxRule) int {
+	score := 0
+	if rule.Region != "" {
+		score += 2
+	}
+	if rule.Class != "" {
+		score++
+	}
+	return score
+}
+
+func (r *TaxRules) Calculate(ctx context.Context, dest TaxDestination, lines []TaxableLine, shipping int64) (*TaxResult, error) {
+	res := &TaxResult{Lines: make([]int64, len(lines)), Taxes: []Tax{}, Included: r.Included}
+	byName := map[string]int{}
+	tax := func(class string, amount int64) int64 {
+		if amount <= 0 {
+			return 0
+		}
+		rules := r.rates(dest, class)
+		sum := 0.0
+		for _, rule := range rules {
+			sum += rule.Rate
+		}
+		total := int64(0)
+		for _, rule := range rules {
+			if rule.Rate == 0 {
+				// an exemption, replacing the rule of the same name
+				continue
+			}
+			var t int64
+			if r.Included {
+				// the part of the amount that is this tax
+				t = int64(math.Round(float64(amount) * rule.Rate / (100 + sum)))
+			} else {
+				t = int64(math.Round(float64(amount) * rule.Rate / 100))
+			}
+			key := fmt.Sprintf("%v|%v", rule.Name, rule.Rate)
+			i, ok := byName[key]
+			if !ok {
+				i = len(res.Taxes)
+				byName[key] = i
+				res.Taxes = append(res.Taxes, Tax{Name: rule.Name, Rate: rule.Rate})
+			}
+			res.Taxes[i].Amount += t
+			total += t
+		}
+		return total
+	}
+	for i, l := range lines {
+		class := l.TaxClass
+		if class == "" {
+			class = defaultTaxClass
+		}
+		res.Lines[i] = tax(class, l.Amount)
+		res.Total += res.Lines[i]
+	}
+	if r.ShippingClass != "" {
+		res.Shipping = tax(r.ShippingClass, shipping)
+		res.Total += res.Shipping
+	}
+	return res, nil
+}
+
+func taxLinesOf(ts []Tax) []*TaxLine {
+	res := []*TaxLine{}
+	for _, t := range ts {
+		res = append(res, &TaxLine{Name: t.Name, Rate: float32(t.Rate), Amount: float32(fromCents(t.Amount))})
+	}
+	return res
+}
+
+func orderTaxesOf(ts []Tax) []MongoOrderTax {
+	var res []MongoOrderTax
+	for _, t := range ts {
+		res = append(res, MongoOrderTax{Name: t.Name, Rate: t.Rate, Amount: fromCents(t.Amount)})
+	}
+	return res
+}
+
+func destinationOf(d TaxDestination) *Destination {
+	if d.IsZero() {
+		return nil
+	}
+	return &Destination{Country: d.Country, Region: d.Region}
+}
+
+func (srv *server) SetCartDestination(ctx context.Context, req *CartDestinationRequest) (*Cart, error) {
+	d := req.GetDestination()
+	ctxLogger(ctx).Debug("SetCartDestination called", zap.String("country", d.GetCountry()), zap.String("region", d.GetRegion()))
+	return srv.changeCart(ctx, true, func(c *MongoCart) error {
+		c.Destination = TaxDestination{Country: d.GetCountry(), Region: d.GetRegion()}
+		return nil
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/metadata"
+)
+
+func testTaxRules() *TaxRules {
+	return &TaxRules{
+		ShippingClass: "shipping",
+		Rules: []TaxRule{
+			{Country: "US", Region: "NY", Name: "State", Rate: 4},
+			{Country: "US", Region: "NY", Name: "Local", Rate: 4.5},
+			{Country: "US", Region: "NY", Class: "books", Name: "Local", Rate: 0},
+			{Country: "BR", Name: "ICMS", Rate: 17},
+			{Country: "BR", Class: "books", Name: "ICMS", Rate: 0},
+			{Country: "BR", Region: "SP", Name: "ICMS", Rate: 18},
+			{Country: "BR", Class: "shipping", Name: "ICMS", Rate: 12},
+		},
+	}
+}
+
+func TestTaxRules(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		included bool
+		dest     TaxDestination
+		lines    []int64
+		shipping int64
+		taxes    string
+	}{
+		{"stacked", false, TaxDestination{"US", "NY"}, []int64{850, 400}, 85, "State 4: 840, Local 4.5: 495"},
+		{"country", false, TaxDestination{"BR", "RJ"}, []int64{1700, 0}, 120, "ICMS 17: 1700, ICMS 12: 120"},
+		{"region wins", false, TaxDestination{"BR", "SP"}, []int64{1800, 1800}, 180, "ICMS 18: 3780"},
+		{"included", true, TaxDestination{"BR", "RJ"}, []int64{1453, 0}, 107, "ICMS 17: 1453, ICMS 12: 107"},
+		{"no rules", false, TaxDestination{"DE", ""}, []int64{0, 0}, 0, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testTaxRules()
+			r.Included = tt.included
+			res, err := r.Calculate(context.Background(), tt.dest, []TaxableLine{
+				{TaxClass: "", Amount: 10000},
+				{TaxClass: "books", Amount: 10000},
+			}, 1000)
+			if err != nil {
+				t.Fatalf("Calculate: %v", err)
+			}
+			taxes := []string{}
+			sum := int64(0)
+			for _, tx := range res.Taxes {
+				taxes = append(taxes, fmt.Sprintf("%v %v: %v", tx.Name, tx.Rate, tx.Amount))
+				sum += tx.Amount
+			}
+			if fmt.Sprint(res.Lines) != fmt.Sprint(tt.lines) || res.Shipping != tt.shipping || strings.Join(taxes, ", ") != tt.taxes {
+				t.Errorf("got %v, %v and %v, want %v, %v and %v", res.Lines, res.Shipping, taxes, tt.lines, tt.shipping, tt.taxes)
+			}
+			if res.Total != sum || res.Included != tt.included {
+				t.Errorf("got total %v included %v, want %v", res.Total, res.Included, sum)
+			}
+		})
+	}
+}
+
+func TestLoadTaxRules(t *testing.T) {
+	if _, err := loadTaxRules("tax_rules.sample.yaml"); err != nil {
+		t.Fatalf("loading the sample: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "ecomm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "taxes.yaml")
+	yml := "rules:\n  - {country: us, name: Sales, rate: 5}\n  - {country: US, rate: 101}\n"
+	if err := ioutil.WriteFile(file, []byte(yml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadTaxRules(file)
+	if err == nil {
+		t.Fatal("expected the invalid rules to fail")
+	}
+	for _, want := range []string{"rules[0].country", "rules[1].name", "rules[1].rate"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %v in %v", want, err)
+		}
+	}
+}
+
+func TestCheckoutTaxes(t *testing.T) {
+	f, cl := newTestClient(t, func(s *server) {
+		s.taxes = testTaxRules()
+		s.taxDestination = TaxDestination{Country: "BR"}
+	})
+	f.store.AddPromotion(&MongoPromotion{Name: "10 off", Type: PromotionFixed, Value: 10, Products: []ObjectID{f.vtm.ID}})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-auth-token", "valid")
+	c, err := cl.AddCartItem(ctx, &CartItemRequest{ProductId: f.vtm.ID.Hex(), Qty: 2})
+	if err != nil {
+		t.Fatalf("AddCartItem: %v", err)
+	}
+	// the default destination, on the line after the discount: 17% of 99.98
+	if c.GetTax() != 17 || c.GetItems()[0].GetTax() != 17 || c.GetTotal() != 116.98 || c.GetTaxIncluded() || c.GetDestination() != nil {
+		t.Fatalf("unexpected taxes: %v", c)
+	}
+	if c, err = cl.SetCartDestination(ctx, &CartDestinationRequest{Destination: &Destination{Country: "US", Region: "NY"}}); err != nil {
+		t.Fatalf("SetCartDestination: %v", err)
+	}
+	if c.GetTax() != 8.5 || len(c.GetTaxes()) != 2 || c.GetDestination().GetRegion() != "NY" {
+		t.Fatalf("unexpected taxes: %v", c)
+	}
+
+	res, err := cl.Checkout(ctx, &CheckoutRequest{CartId: c.GetId()})
+	if err != nil || res.GetTax() != 8.5 || res.GetTotal() != 108.48 {
+		t.Fatalf("Checkout: got %v %v", res, err)
+	}
+	o := f.store.Orders()[0]
+	if o.Tax != 8.5 || o.Items[0].Tax != 8.5 || o.Destination != (TaxDestination{"US", "NY"}) || len(o.Taxes) != 2 ||
+		o.Taxes[0] != (MongoOrderTax{Name: "State", Rate: 4, Amount: 4}) || o.Taxes[1] != (MongoOrderTax{Name: "Local", Rate: 4.5, Amount: 4.5}) {
+		t.Fatalf("unexpected order: %+v", o)
+	}
+
+	// the destination of the request replaces the one of the cart, the taxes are on the store prices
+	res, err = cl.Checkout(ctx, &CheckoutRequest{
+		Cart:        []*CheckoutRequest_Cart{{Product: &Product{Id: f.dice.ID.Hex(), Value: 0.01}, Qty: 10}},
+		Destination: &Destination{Country: "BR", Region: "SP"},
+	})
+	if err != nil || res.GetTax() != 2.7 || res.GetTaxes()[0].GetName() != "ICMS" {
+		t.Fatalf("Checkout: got %v %v", res, err)
+	}
+}
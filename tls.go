@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+)
+
+const defaultTLSReloadInterval = 30 * time.Second
+
+// certReloader keeps the server certificate, and the CAs of the client certificates,
+// reloading them when the files change so they can be rotated without a restart.
+type certReloader struct {
+	cfg TLSConfig
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+func newCertReloader(cfg TLSConfig) (*certReloader, error) {
+	r := &certReloader{cfg: cfg}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	fs := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		fs = append(fs, r.cfg.ClientCAFile)
+	}
+	return fs
+}
+
+func (r *certReloader) reload() error {
+	modTimes := map[string]time.Time{}
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = fi.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		b, err := ioutil.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates in %v", r.cfg.ClientCAFile)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.clientCA, r.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+// changed tells if any of the files was modified since the last reload.
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, f := range r.files() {
+		if fi, err := os.Stat(f); err == nil && !fi.ModTime().Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the files every interval when they change, keeping the current
+// certificate when the new one is invalid, like in the middle of a rotation.
+func (r *certReloader) watch(ctx context.Context) {
+	t := time.NewTicker(r.cfg.ReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.reload(); err != nil {
+				logger.Error("Error reloading TLS certificates", zap.Error(err))
+				continue
+			}
+			logger.Info("TLS certificates reloaded")
+		}
+	}
+}
+
+func (r *certReloader) certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate(), nil
+}
+
+// isOwn tells if the raw certificate is the current certificate of the server.
+func (r *certReloader) isOwn(raw []byte) bool {
+	c := r.certificate()
+	return len(c.Certificate) > 0 && bytes.Equal(c.Certificate[0], raw)
+}
+
+// verifyClient checks the client certificate against the client CAs. The server
+// certificate is accepted too, for the REST gateway calling the gRPC server.
+func (r *certReloader) verifyClient(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		if r.cfg.ClientAuth == "require" {
+			return errors.New("client certificate required")
+		}
+		return nil
+	}
+	if r.isOwn(rawCerts[0]) {
+		return nil
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = c
+	}
+	r.mu.RLock()
+	roots := r.clientCA
+	r.mu.RUnlock()
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// serverTLS is the TLS of the gRPC server and of the REST gateway and gRPC-Web, verifying
+// the client certificates when ClientAuth is optional or require. The HTTP listener checks
+// them too, or the gateway would let the calls without a certificate through.
+func (r *certReloader) serverTLS() *tls.Config {
+	c := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if r.cfg.ClientAuth == "optional" || r.cfg.ClientAuth == "require" {
+		c.ClientAuth = tls.RequestClientCert
+		c.VerifyPeerCertificate = r.verifyClient
+	}
+	return c
+}
+
+// gatewayCredentials are the credentials of the REST gateway to call the gRPC server:
+// it trusts only the server certificate and presents it as its client certificate.
+func (r *certReloader) gatewayCredentials() credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// the server certificate is pinned in VerifyPeerCertificate instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !r.isOwn(rawCerts[0]) {
+				return errors.New("unexpected server certificate")
+			}
+			return nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.certificate(), nil
+		},
+	})
+}
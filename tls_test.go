@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testCA signs the certificates of the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key for the name, usage is server or client auth.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k})
+}
+
+func writeFile(t *testing.T, path string, b []byte) {
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTLSFiles writes a server certificate, and the client CA, returning their config.
+func newTLSFiles(t *testing.T, ca *testCA, clientAuth string) TLSConfig {
+	dir := t.TempDir()
+	cfg := TLSConfig{
+		CertFile:       filepath.Join(dir, "server.pem"),
+		KeyFile:        filepath.Join(dir, "server-key.pem"),
+		ClientCAFile:   filepath.Join(dir, "ca.pem"),
+		ClientAuth:     clientAuth,
+		ReloadInterval: 10 * time.Millisecond,
+	}
+	cert, key := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	writeFile(t, cfg.CertFile, cert)
+	writeFile(t, cfg.KeyFile, key)
+	writeFile(t, cfg.ClientCAFile, ca.pem)
+	return cfg
+}
+
+// dialTLS calls Products on the server with the credentials.
+func dialTLS(t *testing.T, l *bufconn.Listener, creds credentials.TransportCredentials) error {
+	cc, err := grpc.Dial("localhost",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithTransportCredentials(creds),
+	)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer cc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err = NewEcommServiceClient(cc).Products(ctx, &ProductRequest{Qty: 10})
+	return err
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	setLocales("en", []string{"pt-BR"})
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, tt := range []struct {
+		clientAuth string
+		noCert     codes.Code
+	}{
+		{"none", codes.OK},
+		{"optional", codes.OK},
+		{"require", codes.Unavailable},
+	} {
+		t.Run(tt.clientAuth, func(t *testing.T) {
+			r, err := newCertReloader(newTLSFiles(t, ca, tt.clientAuth))
+			if err != nil {
+				t.Fatalf("newCertReloader: %v", err)
+			}
+			f := newFixture()
+			l := bufconn.Listen(1024 * 1024)
+			s := newGRPCServer(newServer(f.store), grpc.Creds(credentials.NewTLS(r.serverTLS())))
+			go s.Serve(l)
+			t.Cleanup(s.Stop)
+
+			err = dialTLS(t, l, credentials.NewTLS(&tls.Config{RootCAs: roots}))
+			assertCode(t, err, tt.noCert)
+
+			cert, key := ca.issue(t, "erp-importer", x509.ExtKeyUsageClientAuth)
+			kp, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = dialTLS(t, l, credentials.NewTLS(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{kp}}))
+			assertCode(t, err, codes.OK)
+
+			if tt.clientAuth != "none" {
+				cert, key = other.issue(t, "intruder", x509.ExtKeyUsageClientAuth)
+				kp, err = tls.X509KeyPair(cert, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = dialTLS(t, l, credentials.NewTLS(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{kp}}))
+				assertCode(t, err, codes.Unavailable)
+			}
+
+			err = dialTLS(t, l, r.gatewayCredentials())
+			assertCode(t, err, codes.OK)
+		})
+	}
+}
+
+func TestHTTPClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cert, key := ca.issue(t, "erp-importer", x509.ExtKeyUsageClientAuth)
+	kp, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		clientAuth string
+		noCert     bool
+	}{
+		{"none", true},
+		{"optional", true},
+		{"require", false},
+	} {
+		t.Run(tt.clientAuth, func(t *testing.T) {
+			r, err := newCertReloader(newTLSFiles(t, ca, tt.clientAuth))
+			if err != nil {
+				t.Fatalf("newCertReloader: %v", err)
+			}
+			_, gw := newTestGateway(t)
+			hs := httptest.NewUnstartedServer(gw.Config.Handler)
+			hs.TLS = r.serverTLS()
+			hs.StartTLS()
+			t.Cleanup(hs.Close)
+
+			get := func(certs ...tls.Certificate) error {
+				cl := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: certs}}}
+				defer cl.CloseIdleConnections()
+				res, err := cl.Get(hs.URL + "/v1/products?start=0&qty=2")
+				if err != nil {
+					return err
+				}
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("got status %v", res.StatusCode)
+				}
+				return nil
+			}
+			if err := get(); (err == nil) != tt.noCert {
+				t.Fatalf("without a client certificate got %v", err)
+			}
+			if err := get(kp); err != nil {
+				t.Fatalf("with a client certificate got %v", err)
+			}
+		})
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	ca := newTestCA(t)
+	cfg := newTLSFiles(t, ca, "none")
+	r, err := newCertReloader(cfg)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	old := r.certificate().Certificate[0]
+	if r.changed() {
+		t.Fatal("changed without a rotation")
+	}
+
+	w := newWorkerGroup()
+	w.Go(r.watch)
+	defer w.Stop(time.Second)
+
+	// a half written rotation keeps the current certificate
+	later := time.Now().Add(time.Minute)
+	writeFile(t, cfg.CertFile, []byte("not a certificate"))
+	os.Chtimes(cfg.CertFile, later, later)
+	time.Sleep(50 * time.Millisecond)
+	if !bytes.Equal(r.certificate().Certificate[0], old) {
+		t.Fatal("invalid certificate was loaded")
+	}
+
+	cert, key := ca.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+	writeFile(t, cfg.CertFile, cert)
+	writeFile(t, cfg.KeyFile, key)
+	later = later.Add(time.Minute)
+	os.Chtimes(cfg.CertFile, later, later)
+	os.Chtimes(cfg.KeyFile, later, later)
+	deadline := time.Now().Add(time.Second)
+	for bytes.Equal(r.certificate().Certificate[0], old) {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated certificate was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/gugazimmermann/go-grpc-ecomm-go"
+
+// newTracerProvider sets the global tracer provider, exporting the spans to stdout or
+// to an OTLP collector, and the W3C trace context propagation. With no exporter the
+// spans are not recorded but the trace context of the callers is still propagated.
+func newTracerProvider(ctx context.Context, cfg TracingConfig) (*sdktrace.TracerProvider, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var exp sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "none":
+		return nil, nil
+	case "stdout":
+		exp, err = stdout.NewExporter(stdout.WithWriter(os.Stdout), stdout.WithoutMetricExport())
+	case "otlp":
+		exp, err = otlp.NewExporter(ctx, otlpgrpc.NewDriver(otlpgrpc.WithInsecure(), otlpgrpc.WithEndpoint(cfg.OTLPEndpoint)))
+	default:
+		err = fmt.Errorf("unknown exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String("ecomm"))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp, nil
+}
+
+// startQuery starts the span of a MongoDB query, with the stages of the pipeline but not
+// their values, and end finishes it and records the query metrics.
+func startQuery(ctx context.Context, name string, coll *mongo.Collection, op string, pipeline mongo.Pipeline) (context.Context, func(err *error)) {
+	start := time.Now()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "mongo "+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemMongodb,
+			semconv.DBOperationKey.String(op),
+			semconv.DBMongoDBCollectionKey.String(coll.Name()),
+			attribute.String("ecomm.pipeline", name),
+			attribute.String("ecomm.pipeline.shape", pipelineShape(pipeline)),
+		))
+	return ctx, func(err *error) {
+		if *err != nil {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+		observeQuery(name, start, err)
+	}
+}
+
+// pipelineShape returns the stages of the pipeline, like "$match,$graphLookup".
+func pipelineShape(pipeline mongo.Pipeline) string {
+	stages := []string{}
+	for _, s := range pipeline {
+		for _, e := range s {
+			stages = append(stages, e.Key)
+		}
+	}
+	return strings.Join(stages, ",")
+}
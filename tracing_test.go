@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/metadata"
+)
+
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exp := tracetest.NewInMemoryExporter()
+	old, oldProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(old)
+		otel.SetTextMapPropagator(oldProp)
+	})
+	return exp
+}
+
+func TestTracing(t *testing.T) {
+	exp := recordSpans(t)
+	f, cl := newTestClient(t)
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		"traceparent", "00-"+traceID+"-00f067aa0ba902b7-01",
+		"x-user-auth-token", "valid",
+	)
+	_, err := cl.Checkout(ctx, &CheckoutRequest{Cart: []*CheckoutRequest_Cart{
+		{Product: &Product{Id: f.vtm.ID.Hex(), Name: f.vtm.Name, Value: 54.99}, Qty: 1},
+	}})
+	if err != nil {
+		t.Fatalf("Checkout: %v", err)
+	}
+
+	names := map[string]bool{}
+	for _, s := range exp.GetSpans() {
+		if s.SpanContext.TraceID().String() != traceID {
+			t.Errorf("span %v: got trace %v, want %v", s.Name, s.SpanContext.TraceID(), traceID)
+		}
+		names[s.Name] = true
+	}
+	if !names["ecomm.EcommService/Checkout"] {
+		t.Errorf("missing the RPC span, got %v", names)
+	}
+	if !names["keycloak POST"] {
+		t.Errorf("missing the Keycloak span, got %v", names)
+	}
+}
+
+func TestStartQuery(t *testing.T) {
+	exp := recordSpans(t)
+	client, err := mongo.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll := client.Database("test").Collection("categories")
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "slug", Value: "secret"}}}},
+		{{Key: "$graphLookup", Value: bson.D{}}},
+	}
+	_, end := startQuery(context.Background(), "breadcrumb", coll, "aggregate", pipeline)
+	err = errors.New("boom")
+	end(&err)
+
+	spans := exp.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "mongo breadcrumb" {
+		t.Fatalf("unexpected spans: %v", spans)
+	}
+	attrs := map[attribute.Key]string{}
+	for _, a := range spans[0].Attributes {
+		attrs[a.Key] = a.Value.Emit()
+	}
+	if attrs["ecomm.pipeline.shape"] != "$match,$graphLookup" || attrs["db.mongodb.collection"] != "categories" {
+		t.Errorf("unexpected attributes: %v", attrs)
+	}
+	if spans[0].StatusCode.String() != "Error" {
+		t.Errorf("got status %v, want Error", spans[0].StatusCode)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const defaultMaxPageSize = 100
+
+var maxPageSize int32 = defaultMaxPageSize
+
+// patterns keeps the compiled (rules).pattern regexps.
+var patterns sync.Map
+
+// validationInterceptor checks the request against the (rules) options of ecomm.proto and
+// returns InvalidArgument with a BadRequest listing every field violation.
+func validationInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if m, ok := req.(proto.Message); ok {
+		if vs := validate(m.ProtoReflect(), ""); len(vs) > 0 {
+			st := status.New(codes.InvalidArgument, "Invalid request")
+			if ds, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: vs}); err == nil {
+				st = ds
+			}
+			return nil, st.Err()
+		}
+	}
+	return handler(ctx, req)
+}
+
+func validate(m protoreflect.Message, prefix string) []*errdetails.BadRequest_FieldViolation {
+	vs := []*errdetails.BadRequest_FieldViolation{}
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		path := prefix + string(fd.Name())
+		if r := fieldRules(fd); r != nil {
+			for _, d := range check(m, fd, r) {
+				vs = append(vs, &errdetails.BadRequest_FieldViolation{Field: path, Description: d})
+			}
+		}
+		if fd.Kind() != protoreflect.MessageKind || fd.IsMap() {
+			continue
+		}
+		if fd.IsList() {
+			l := m.Get(fd).List()
+			for j := 0; j < l.Len(); j++ {
+				vs = append(vs, validate(l.Get(j).Message(), fmt.Sprintf("%v[%d].", path, j))...)
+			}
+		} else if m.Has(fd) {
+			vs = append(vs, validate(m.Get(fd).Message(), path+".")...)
+		}
+	}
+	return vs
+}
+
+func fieldRules(fd protoreflect.FieldDescriptor) *FieldRules {
+	opts, ok := fd.Options().(*descriptorpb.FieldOptions)
+	if !ok || opts == nil || !proto.HasExtension(opts, E_Rules) {
+		return nil
+	}
+	r, _ := proto.GetExtension(opts, E_Rules).(*FieldRules)
+	return r
+}
+
+// check returns the description of each rule the field breaks.
+func check(m protoreflect.Message, fd protoreflect.FieldDescriptor, r *FieldRules) []string {
+	res := []string{}
+	v := m.Get(fd)
+	if fd.IsList() {
+		n := uint32(v.List().Len())
+		if r.GetRequired() && n == 0 {
+			res = append(res, "must not be empty")
+		}
+		if r.MinItems != nil && n < r.GetMinItems() {
+			res = append(res, fmt.Sprintf("must have at least %d items", r.GetMinItems()))
+		}
+		if r.MaxItems != nil && n > r.GetMaxItems() {
+			res = append(res, fmt.Sprintf("must have at most %d items", r.GetMaxItems()))
+		}
+		return res
+	}
+	switch fd.Kind() {
+	case protoreflect.MessageKind:
+		if r.GetRequired() && !m.Has(fd) {
+			res = append(res, "is required")
+		}
+	case protoreflect.StringKind:
+		s := v.String()
+		if s == "" {
+			if r.GetRequired() {
+				res = append(res, "must not be empty")
+			}
+			return res
+		}
+		if r.MaxLen != nil && uint32(utf8.RuneCountInString(s)) > r.GetMaxLen() {
+			res = append(res, fmt.Sprintf("must be at most %d characters", r.GetMaxLen()))
+		}
+		if r.Pattern != nil && !pattern(r.GetPattern()).MatchString(s) {
+			res = append(res, fmt.Sprintf("must match %v", r.GetPattern()))
+		}
+		if r.GetObjectId() {
+			if _, err := ObjectIDFromHex(s); err != nil {
+				res = append(res, "must be a valid id")
+			}
+		}
+	case protoreflect.Int32Kind:
+		n := int32(v.Int())
+		if r.Gte != nil && n < r.GetGte() {
+			res = append(res, fmt.Sprintf("must be greater than or equal to %d", r.GetGte()))
+		}
+		if r.Lte != nil && n > r.GetLte() {
+			res = append(res, fmt.Sprintf("must be less than or equal to %d", r.GetLte()))
+		}
+		if r.GetPageSize() && (n < 1 || n > maxPageSize) {
+			res = append(res, fmt.Sprintf("must be between 1 and %d", maxPageSize))
+		}
+	}
+	return res
+}
+
+func pattern(p string) *regexp.Regexp {
+	if re, ok := patterns.Load(p); ok {
+		return re.(*regexp.Regexp)
+	}
+	re := regexp.MustCompile(p)
+	patterns.Store(p, re)
+	return re
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/gugazimmermann/go-grpc-ecomm-go/ecommpb/ecommpb"
+	. "go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		req  proto.Message
+		want []string
+	}{
+		{"valid products", &ProductRequest{Start: 0, Qty: 10}, []string{}},
+		{"negative start", &ProductRequest{Start: -1, Qty: 10}, []string{"start"}},
+		{"zero qty", &ProductRequest{Qty: 0}, []string{"qty"}},
+		{"huge qty", &SearchProductsRequest{Name: "drag", Qty: maxPageSize + 1}, []string{"qty"}},
+		{"empty slug", &CategoryRequest{}, []string{"slug"}},
+		{"invalid slug", &CategoryRequest{Slug: "a/b"}, []string{"slug"}},
+		{"translated slug", &CategoryRequest{Slug: "jogos-de-interpretação"}, []string{}},
+		{"empty tree slug", &CategoryTreeRequest{}, []string{}},
+		{"deep tree", &CategoryTreeRequest{Depth: 21}, []string{"depth"}},
+		{"invalid category id", &ProductFromCategoryRequest{CategoryId: "abc", Qty: 1}, []string{"categoryId"}},
+		{"invalid cart id", &CheckoutRequest{CartId: "x"}, []string{"cart_id"}},
+		{"cart item", &CartItemRequest{ProductId: NewObjectID().Hex(), Qty: 1}, []string{}},
+		{"invalid cart item", &CartItemRequest{Qty: 101}, []string{"product_id", "qty"}},
+		{"destination", &CartDestinationRequest{Destination: &Destination{Country: "US", Region: "NY"}}, []string{}},
+		{"invalid destination", &CheckoutRequest{CartId: NewObjectID().Hex(), Destination: &Destination{Country: "usa", Region: "new-york"}},
+			[]string{"destination.country", "destination.region"}},
+		{"invalid cart", &CheckoutRequest{Cart: []*CheckoutRequest_Cart{
+			{Product: &Product{Id: NewObjectID().Hex()}, Qty: 1},
+			{Qty: 0},
+			{Product: &Product{Id: "x"}, Qty: 1},
+		}}, []string{"cart[1].product", "cart[1].qty", "cart[2].product.id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, v := range validate(tt.req.ProtoReflect(), "") {
+				got = append(got, v.Field)
+			}
+			if !equal(got, tt.want) {
+				t.Fatalf("expected violations %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidationInterceptor(t *testing.T) {
+	_, cl := newTestClient(t)
+	_, err := cl.SearchProducts(context.Background(), &SearchProductsRequest{Start: -1, Qty: 10})
+	assertCode(t, err, codes.InvalidArgument)
+	st, _ := status.FromError(err)
+	fields := []string{}
+	for _, d := range st.Details() {
+		if br, ok := d.(*errdetails.BadRequest); ok {
+			for _, v := range br.FieldViolations {
+				fields = append(fields, v.Field)
+			}
+		}
+	}
+	if !equal(fields, []string{"name", "start"}) {
+		t.Fatalf("unexpected field violations: %v", fields)
+	}
+}